@@ -1,11 +1,18 @@
 package main
 
 import (
+	"cmp"
+	"crypto/tls"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"chatui/internal/client"
+	"chatui/internal/logging"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -17,15 +24,123 @@ func main() {
 }
 
 func run() error {
-	if len(os.Args) < 2 {
-		return errors.New("please provide the server address as an argument")
+	configPath := flag.String("config", client.DefaultConfigPath(), "configuration file holding the saved profiles")
+	profileName := flag.String("profile", "", "saved profile to connect and log in with; flags win over its settings")
+	themeName := flag.String("theme", "", "colors of the UI: "+strings.Join(client.ThemeNames(), ", ")+", or a theme file (default dark, or the theme of the configuration)")
+	path := flag.String("path", client.DefaultPath, "URL path of the chat on the server, when the address has none")
+	useTLS := flag.Bool("tls", false, "connect over wss://")
+	caFile := flag.String("ca", "", "CA bundle to verify the server with instead of the system roots")
+	certFile := flag.String("cert", "", "client certificate for mutual TLS")
+	keyFile := flag.String("key", "", "private key of the client certificate")
+	insecure := flag.Bool("insecure-skip-verify", false, "do not verify the server certificate (development only)")
+	logFile := flag.String("log-file", defaultLogFile(), "file the client logs to; the terminal belongs to the UI")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum level logged: debug, info, warn or error")
+	flag.Parse()
+
+	cfg, err := client.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	var profile client.Profile
+	if *profileName != "" {
+		var ok bool
+		if profile, ok = cfg.Profile(*profileName); !ok {
+			return fmt.Errorf("no profile %q in %s", *profileName, *configPath)
+		}
+	}
+
+	if *themeName == "" {
+		*themeName = cmp.Or(cfg.Theme(), "dark")
+	}
+	theme, err := client.LoadTheme(*themeName)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, setting := range []struct {
+		name  string
+		value *string
+		saved string
+	}{
+		{"ca", caFile, profile.CA},
+		{"cert", certFile, profile.Cert},
+		{"key", keyFile, profile.Key},
+	} {
+		if !set[setting.name] && setting.saved != "" {
+			*setting.value = setting.saved
+		}
+	}
+	if !set["path"] && profile.Path != "" {
+		*path = profile.Path
+	}
+	if !set["tls"] {
+		*useTLS = profile.TLS
+	}
+	if !set["insecure-skip-verify"] {
+		*insecure = profile.InsecureSkipVerify
+	}
+
+	serverAddr := profile.Address
+	if flag.NArg() > 0 {
+		serverAddr = flag.Arg(0)
+	}
+	if serverAddr == "" {
+		return errors.New("please provide the server address as an argument, or a saved -profile")
+	}
+
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" || *certFile != "" || *insecure {
+		var err error
+		tlsConfig, err = client.CreateTLSConfig(*caFile, *certFile, *keyFile, *insecure)
+		if err != nil {
+			return err
+		}
+	}
+	serverURL, err := client.ServerURL(serverAddr, *path, tlsConfig != nil)
+	if err != nil {
+		return err
 	}
 
-	serverAddr := os.Args[1]
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(*logFile), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	logger, err := logging.New(f, *logFormat, level)
+	if err != nil {
+		return err
+	}
+	logger.Info("starting", "server", serverURL, "profile", *profileName)
 
-	p := tea.NewProgram(client.InitialModel(serverAddr), tea.WithAltScreen())
+	m := client.InitialModel(serverURL, tlsConfig, logger).WithTheme(theme)
+	if *profileName != "" {
+		m = m.WithProfile(cfg, *profileName)
+	}
+	p := tea.NewProgram(m, tea.WithAltScreen())
 
-	_, err := p.Run()
+	_, err = p.Run()
 
 	return err
 }
+
+// defaultLogFile returns client.log in the user's cache directory, or in the
+// temporary directory if there is none.
+func defaultLogFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "chatui", "client.log")
+}
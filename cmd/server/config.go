@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatui/internal/logging"
+	message "chatui/internal/protocol"
+	"chatui/internal/server"
+)
+
+// envPrefix starts the environment variables overriding settings: -max-message-length
+// is overridden by CHATUI_MAX_MESSAGE_LENGTH.
+const envPrefix = "CHATUI_"
+
+// reloadable are the settings a SIGHUP applies; the others need a restart.
+var reloadable = []string{
+	"motd", "origins", "max-message-length", "max-username-length", "connection-time",
+	"message-limit", "login-limit", "typing-limit", "ip-limit-factor", "mute-after", "mute-duration",
+	"disconnect-after", "strike-window", "log-level",
+}
+
+// config holds every setting of the server. Each can be given as a flag, as
+// an environment variable named after it, or under its name in the JSON
+// config file. Flags win over the environment, which wins over the file.
+type config struct {
+	configPath  string
+	checkConfig bool
+
+	listen            string
+	path              string
+	origins           string
+	motd              string
+	maxMessageLength  int
+	maxUsernameLength int
+	connectionTime    time.Duration
+	readTimeout       time.Duration
+	httpWriteTimeout  time.Duration
+	shutdownTimeout   time.Duration
+
+	historyPath       string
+	historyMax        int
+	usersPath         string
+	certFile          string
+	keyFile           string
+	clientCA          string
+	requireClientCert bool
+	queueSize         int
+	writeTimeout      time.Duration
+	overflow          string
+	offlineMax        int
+	offlineMaxAge     time.Duration
+	moderationPath    string
+	auditPath         string
+	admins            string
+	moderators        string
+	botNames          string
+	standupAt         string
+	standupChannel    string
+	apiKeysPath       string
+	webhooksPath      string
+	messageLimit      string
+	loginLimit        string
+	typingLimit       string
+	ipLimitFactor     int
+	muteAfter         int
+	muteDuration      time.Duration
+	disconnectAfter   int
+	strikeWindow      time.Duration
+	logFormat         string
+	logLevel          string
+
+	// values holds every setting as text, to tell what a reload changed.
+	values map[string]string
+}
+
+func newFlagSet(cfg *config) *flag.FlagSet {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: server [flags] [address]\n\n")
+		fmt.Fprintf(fs.Output(), "Every flag can also be set in the -config file, under its name, or in the\n")
+		fmt.Fprintf(fs.Output(), "environment as %s followed by its name in upper case with dashes as\n", envPrefix)
+		fmt.Fprintf(fs.Output(), "underscores. Flags win over the environment, which wins over the file.\n\n")
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&cfg.configPath, "config", os.Getenv(envPrefix+"CONFIG"), "JSON file of settings, keyed by flag name")
+	fs.BoolVar(&cfg.checkConfig, "check-config", false, "check the configuration and the files it names, then exit")
+
+	fs.StringVar(&cfg.listen, "listen", "", "address to listen on, such as :8080 (may also be given as the first argument)")
+	fs.StringVar(&cfg.path, "path", "/", "URL path clients connect to")
+	fs.StringVar(&cfg.origins, "origins", "", "comma separated host patterns of other web pages allowed to connect, such as *.example.com")
+	fs.StringVar(&cfg.motd, "motd", "", "message of the day shown to users when they log in")
+	fs.IntVar(&cfg.maxMessageLength, "max-message-length", server.DefaultServerOptions.MaxMessageLength, "most characters a chat message may have")
+	fs.IntVar(&cfg.maxUsernameLength, "max-username-length", server.DefaultServerOptions.MaxUsernameLength, "most bytes a username may have")
+	fs.DurationVar(&cfg.connectionTime, "connection-time", server.DefaultServerOptions.MaxConnectionTime, "how long a connection may stay open before it is closed")
+	fs.DurationVar(&cfg.readTimeout, "http-read-timeout", time.Second*10, "time allowed to read an HTTP request")
+	fs.DurationVar(&cfg.httpWriteTimeout, "http-write-timeout", time.Second*10, "time allowed to write an HTTP response")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", time.Second*10, "time allowed for requests to finish on shutdown")
+
+	fs.StringVar(&cfg.historyPath, "history", "", "file to persist message history to (kept in memory if empty)")
+	fs.IntVar(&cfg.historyMax, "history-max", 10000, "most messages kept in history; older ones are forgotten")
+	fs.StringVar(&cfg.usersPath, "users", "users.json", "file storing accounts and session tokens")
+	fs.StringVar(&cfg.certFile, "cert", "", "TLS certificate file; serves wss:// when set together with -key")
+	fs.StringVar(&cfg.keyFile, "key", "", "TLS private key file")
+	fs.StringVar(&cfg.clientCA, "client-ca", "", "CA bundle used to verify client certificates; their common name becomes the username")
+	fs.BoolVar(&cfg.requireClientCert, "require-client-cert", false, "refuse TLS connections without a valid client certificate")
+	fs.IntVar(&cfg.queueSize, "send-queue", server.DefaultQueueOptions.Size, "envelopes buffered per client before the overflow policy applies")
+	fs.DurationVar(&cfg.writeTimeout, "write-timeout", server.DefaultQueueOptions.WriteTimeout, "time allowed for a single write to a client")
+	fs.StringVar(&cfg.overflow, "overflow", string(server.DefaultQueueOptions.Policy), "what to do when a client's queue is full: drop-oldest or disconnect")
+	fs.IntVar(&cfg.offlineMax, "offline-max", server.DefaultOfflineOptions.MaxMessages, "direct messages kept per offline user (0 disables the queue)")
+	fs.DurationVar(&cfg.offlineMaxAge, "offline-max-age", server.DefaultOfflineOptions.MaxAge, "discard queued direct messages older than this (0 keeps them)")
+	fs.StringVar(&cfg.moderationPath, "moderation", "moderation.json", "file storing user roles and bans")
+	fs.StringVar(&cfg.auditPath, "audit-log", "", "file moderation actions are appended to (only logged if empty)")
+	fs.StringVar(&cfg.admins, "admins", "", "comma separated users given the admin role on startup")
+	fs.StringVar(&cfg.moderators, "moderators", "", "comma separated users given the moderator role on startup")
+	fs.StringVar(&cfg.botNames, "bots", "", "comma separated bots to run: dice, standup")
+	fs.StringVar(&cfg.standupAt, "standup-at", "09:30", "local time at which the standup bot posts its reminder")
+	fs.StringVar(&cfg.standupChannel, "standup-channel", "ALL", "channel the standup bot posts its reminder in")
+	fs.StringVar(&cfg.apiKeysPath, "api-keys", "", "JSON file mapping names to the keys allowed to POST /api/messages (API disabled if empty)")
+	fs.StringVar(&cfg.webhooksPath, "webhooks", "", "JSON file listing the outgoing webhooks")
+	fs.StringVar(&cfg.messageLimit, "message-limit", server.DefaultRateLimitOptions.Messages.String(), "messages, edits, reactions, read receipts, thread, channel and moderation requests allowed per user, as count/duration (0 disables)")
+	fs.StringVar(&cfg.loginLimit, "login-limit", server.DefaultRateLimitOptions.Logins.String(), "login attempts, and anything else sent before logging in, allowed per user from each address, as count/duration (0 disables)")
+	fs.StringVar(&cfg.typingLimit, "typing-limit", server.DefaultRateLimitOptions.Typing.String(), "typing notifications allowed per user, as count/duration (0 disables)")
+	fs.IntVar(&cfg.ipLimitFactor, "ip-limit-factor", server.DefaultRateLimitOptions.IPFactor, "how many times the per-user limits every IP address is allowed")
+	fs.IntVar(&cfg.muteAfter, "mute-after", server.DefaultRateLimitOptions.MuteAfter, "mute a client the Nth time it goes over the limits (0 never mutes)")
+	fs.DurationVar(&cfg.muteDuration, "mute-duration", server.DefaultRateLimitOptions.MuteDuration, "how long clients that keep going over the limits are muted")
+	fs.IntVar(&cfg.disconnectAfter, "disconnect-after", server.DefaultRateLimitOptions.DisconnectAfter, "disconnect a client the Nth time it goes over the limits (0 never disconnects)")
+	fs.DurationVar(&cfg.strikeWindow, "strike-window", server.DefaultRateLimitOptions.StrikeWindow, "time without going over the limits after which a client's count starts again")
+	fs.StringVar(&cfg.logFormat, "log-format", "text", "format of the log written to stderr: text or json")
+	fs.StringVar(&cfg.logLevel, "log-level", "info", "lowest level logged: debug, info, warn or error")
+	return fs
+}
+
+// loadConfig reads the settings from args, the environment and the config
+// file, in that order of precedence.
+func loadConfig(args []string) (*config, error) {
+	cfg := &config{}
+	fs := newFlagSet(cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 1 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args()[1:], " "))
+	}
+
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	if cfg.configPath != "" {
+		if err := applyConfigFile(fs, cfg.configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "check-config" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid value %q: %w", name, value, err))
+			}
+		}
+	})
+	for name, value := range flags {
+		fs.Set(name, value)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() == 1 {
+		cfg.listen = fs.Arg(0)
+	}
+
+	cfg.values = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		cfg.values[f.Name] = f.Value.String()
+	})
+	return cfg, nil
+}
+
+// applyConfigFile sets the flags named by the keys of the JSON object in
+// path. Values are strings, numbers, booleans, or arrays of strings for the
+// comma separated settings.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("reading config from %s: %w", path, err)
+	}
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		if fs.Lookup(name) == nil || name == "config" || name == "check-config" {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, name))
+			continue
+		}
+		value, err := settingText(settings[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, name, err))
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: invalid value %q: %w", path, name, value, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// settingText returns a JSON value of the config file as flag text.
+func settingText(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) > 0 && raw[0] == '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case len(raw) > 0 && raw[0] == '[':
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return "", errors.New("expected an array of strings")
+		}
+		return strings.Join(list, ","), nil
+	case string(raw) == "true" || string(raw) == "false":
+		return string(raw), nil
+	default:
+		if _, err := strconv.ParseFloat(string(raw), 64); err != nil {
+			return "", errors.New("expected a string, number, boolean or array of strings")
+		}
+		return string(raw), nil
+	}
+}
+
+// settings are the parts of the configuration that need parsing, checked
+// once so that a bad value is reported before anything starts.
+type settings struct {
+	policy     server.OverflowPolicy
+	limits     server.RateLimitOptions
+	options    server.ServerOptions
+	logLevel   slog.Level
+	moderators map[message.Role][]string
+	useTLS     bool
+}
+
+func (cfg *config) check() (*settings, error) {
+	var s settings
+	var err error
+
+	if cfg.listen == "" {
+		return nil, errors.New("please provide an address to listen on with -listen or as the first argument")
+	}
+	if !strings.HasPrefix(cfg.path, "/") {
+		return nil, fmt.Errorf("-path must start with a slash, got %q", cfg.path)
+	}
+	if cfg.maxMessageLength < 1 || cfg.maxUsernameLength < 1 {
+		return nil, errors.New("-max-message-length and -max-username-length must be at least 1")
+	}
+	if cfg.connectionTime <= 0 {
+		return nil, errors.New("-connection-time must be positive")
+	}
+
+	if cfg.historyMax < 1 {
+		return nil, errors.New("-history-max must be at least 1")
+	}
+
+	if s.policy, err = server.ParseOverflowPolicy(cfg.overflow); err != nil {
+		return nil, err
+	}
+	if cfg.queueSize < 1 {
+		return nil, errors.New("-send-queue must be at least 1")
+	}
+
+	s.limits = server.DefaultRateLimitOptions
+	s.limits.IPFactor = cfg.ipLimitFactor
+	s.limits.MuteAfter = cfg.muteAfter
+	s.limits.MuteDuration = cfg.muteDuration
+	s.limits.DisconnectAfter = cfg.disconnectAfter
+	s.limits.StrikeWindow = cfg.strikeWindow
+	if cfg.muteAfter < 0 || cfg.disconnectAfter < 0 || cfg.strikeWindow <= 0 {
+		return nil, errors.New("-mute-after and -disconnect-after cannot be negative, and -strike-window must be positive")
+	}
+	for _, l := range []struct {
+		value string
+		limit *server.RateLimit
+	}{
+		{cfg.messageLimit, &s.limits.Messages},
+		{cfg.loginLimit, &s.limits.Logins},
+		{cfg.typingLimit, &s.limits.Typing},
+	} {
+		if *l.limit, err = server.ParseRateLimit(l.value); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.logLevel, err = logging.ParseLevel(cfg.logLevel); err != nil {
+		return nil, err
+	}
+	if _, err := logging.New(io.Discard, cfg.logFormat, s.logLevel); err != nil {
+		return nil, err
+	}
+
+	s.options = server.ServerOptions{
+		MaxMessageLength:  cfg.maxMessageLength,
+		MaxUsernameLength: cfg.maxUsernameLength,
+		MaxConnectionTime: cfg.connectionTime,
+		AllowedOrigins:    splitList(cfg.origins),
+		MOTD:              cfg.motd,
+	}
+
+	s.moderators = map[message.Role][]string{
+		message.RoleModerator: splitList(cfg.moderators),
+		message.RoleAdmin:     splitList(cfg.admins),
+	}
+
+	s.useTLS = cfg.certFile != "" || cfg.keyFile != ""
+	if s.useTLS && (cfg.certFile == "" || cfg.keyFile == "") {
+		return nil, errors.New("both -cert and -key are required to serve TLS")
+	}
+	if !s.useTLS && (cfg.clientCA != "" || cfg.requireClientCert) {
+		return nil, errors.New("client certificates require -cert and -key")
+	}
+	return &s, nil
+}
+
+// changed returns the settings whose values differ in next.
+func (cfg *config) changed(next *config) []string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(cfg.values)) {
+		if cfg.values[name] != next.values[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// reloaded returns the configuration in force once next was reloaded: the
+// reloadable settings of next, and the others as the server started with.
+func (cfg *config) reloaded(next *config) *config {
+	merged := &config{values: make(map[string]string)}
+	fs := newFlagSet(merged)
+	for name, value := range cfg.values {
+		if slices.Contains(reloadable, name) {
+			value = next.values[name]
+		}
+		fs.Set(name, value)
+		merged.values[name] = value
+	}
+	return merged
+}
+
+func splitList(s string) []string {
+	var list []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
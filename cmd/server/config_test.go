@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadedKeepsStartupSettings(t *testing.T) {
+	start, err := loadConfig([]string{"-motd", "a", "-shutdown-timeout", "3s", "127.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := loadConfig([]string{"-motd", "b", "-shutdown-timeout", "9s", "127.0.0.1:9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := start.reloaded(next)
+	if cfg.motd != "b" {
+		t.Errorf("motd = %q, want the reloaded b", cfg.motd)
+	}
+	if cfg.listen != "127.0.0.1:8080" || cfg.shutdownTimeout != 3*time.Second {
+		t.Errorf("listen = %q, shutdown-timeout = %v, want those the server started with", cfg.listen, cfg.shutdownTimeout)
+	}
+
+	// A second reload still compares against what the server runs with.
+	changed := cfg.changed(next)
+	if len(changed) != 2 || changed[0] != "listen" || changed[1] != "shutdown-timeout" {
+		t.Errorf("changed = %v, want listen and shutdown-timeout", changed)
+	}
+}
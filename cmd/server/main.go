@@ -2,14 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"syscall"
 	"time"
 
+	"chatui/internal/bots"
+	"chatui/internal/logging"
+	message "chatui/internal/protocol"
 	"chatui/internal/server"
 )
 
@@ -21,44 +30,231 @@ func main() {
 }
 
 func run() error {
-	hub := server.CreateHub()
-	go hub.Run()
-	cs := server.CreateChatServer(log.Printf, hub)
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	set, err := cfg.check()
+	if err != nil {
+		return err
+	}
 
-	if len(os.Args) < 2 {
-		return errors.New("please provide an address to listen on as the first argument")
+	// Load what the settings point to before opening any store, so that
+	// -check-config catches bad files without creating any.
+	var apiKeys map[string]string
+	if cfg.apiKeysPath != "" {
+		if apiKeys, err = server.LoadAPIKeys(cfg.apiKeysPath); err != nil {
+			return err
+		}
+	}
+	var hooks []server.Webhook
+	if cfg.webhooksPath != "" {
+		if hooks, err = server.LoadWebhooks(cfg.webhooksPath); err != nil {
+			return err
+		}
+	}
+	var chatBots []server.Bot
+	for _, name := range splitList(cfg.botNames) {
+		switch name {
+		case "dice":
+			chatBots = append(chatBots, bots.CreateDice())
+		case "standup":
+			bot, err := bots.CreateStandup(cfg.standupChannel, cfg.standupAt)
+			if err != nil {
+				return err
+			}
+			chatBots = append(chatBots, bot)
+		default:
+			return fmt.Errorf("unknown bot %q", name)
+		}
+	}
+	var tlsConfig *tls.Config
+	if set.useTLS {
+		if _, err := tls.LoadX509KeyPair(cfg.certFile, cfg.keyFile); err != nil {
+			return err
+		}
+		if tlsConfig, err = server.CreateTLSConfig(cfg.clientCA, cfg.requireClientCert); err != nil {
+			return err
+		}
+	}
+	if cfg.checkConfig {
+		fmt.Println("configuration ok")
+		return nil
 	}
 
-	l, err := net.Listen("tcp", os.Args[1])
+	var level slog.LevelVar
+	level.Set(set.logLevel)
+	logger, err := logging.New(os.Stderr, cfg.logFormat, &level)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("listening on ws://%v", l.Addr())
+	var history server.HistoryStore = server.CreateMemoryHistory(cfg.historyMax)
+	if cfg.historyPath != "" {
+		fh, err := server.OpenFileHistory(cfg.historyPath, cfg.historyMax, logger)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		history = fh
+	}
+
+	users, err := server.OpenUserStore(cfg.usersPath)
+	if err != nil {
+		return err
+	}
+
+	hub := server.CreateHub(history, server.QueueOptions{
+		Size:         cfg.queueSize,
+		WriteTimeout: cfg.writeTimeout,
+		Policy:       set.policy,
+	}, server.OfflineOptions{
+		MaxMessages: cfg.offlineMax,
+		MaxAge:      cfg.offlineMaxAge,
+		IsKnownUser: users.Exists,
+	})
+	hub.SetLogger(logger)
+	moderation, err := server.OpenModerationStore(cfg.moderationPath)
+	if err != nil {
+		return err
+	}
+	// The flags only grant roles; those given earlier are kept until an
+	// admin takes them back.
+	granted := make(map[string]bool)
+	for _, role := range []message.Role{message.RoleModerator, message.RoleAdmin} {
+		for _, username := range set.moderators[role] {
+			if err := moderation.SetRole(username, role); err != nil {
+				return err
+			}
+			granted[username] = true
+		}
+	}
+	for username, role := range moderation.Staff() {
+		if !granted[username] {
+			logger.Info("keeping role not given on the command line", "username", username, "role", role)
+		}
+	}
+	var audit *server.AuditLog
+	if cfg.auditPath != "" {
+		audit, err = server.OpenAuditLog(cfg.auditPath)
+		if err != nil {
+			return err
+		}
+		defer audit.Close()
+	}
+	hub.SetModeration(moderation, audit)
+	for _, bot := range chatBots {
+		hub.AddBot(bot)
+	}
+	for _, hook := range hooks {
+		if err := hub.AddWebhook(hook); err != nil {
+			return err
+		}
+	}
+	go hub.Run()
+	cs := server.CreateChatServer(logger, hub, users)
+	cs.SetRateLimits(set.limits)
+	cs.SetOptions(set.options)
+	if apiKeys != nil {
+		cs.SetAPIKeys(apiKeys)
+	}
+
+	l, err := net.Listen("tcp", cfg.listen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.path, cs)
+	mux.Handle("/api/", cs.APIHandler())
+	mux.Handle("GET /metrics", hub.Metrics())
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		if !hub.Ready(ctx) {
+			http.Error(w, "hub not responding", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
 
 	s := &http.Server{
-		Handler:      cs,
-		ReadTimeout:  time.Second * 10,
-		WriteTimeout: time.Second * 10,
+		Handler:      mux,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  cfg.readTimeout,
+		WriteTimeout: cfg.httpWriteTimeout,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+
+	if set.useTLS {
+		logger.Info("listening", "addr", "wss://"+l.Addr().String(), "path", cfg.path)
+	} else {
+		logger.Info("listening", "addr", "ws://"+l.Addr().String(), "path", cfg.path)
 	}
 
 	errc := make(chan error, 1)
 	go func() {
+		if set.useTLS {
+			errc <- s.ServeTLS(l, cfg.certFile, cfg.keyFile)
+			return
+		}
 		errc <- s.Serve(l)
 	}()
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	select {
-	case err := <-errc:
-		log.Printf("failed to serve: %v", err)
-	case sig := <-sigs:
-		log.Printf("terminating: %v", sig)
+serve:
+	for {
+		select {
+		case err := <-errc:
+			logger.Error("failed to serve", "err", err)
+			break serve
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				logger.Info("terminating", "signal", sig)
+				break serve
+			}
+			next, err := reload(cs, &level)
+			if err != nil {
+				logger.Error("failed to reload the configuration, keeping the current one", "err", err)
+				continue
+			}
+			for _, name := range cfg.changed(next) {
+				if !slices.Contains(reloadable, name) {
+					logger.Warn("setting changed, restart the server to apply it", "setting", name)
+				}
+			}
+			cfg = cfg.reloaded(next)
+			logger.Info("configuration reloaded")
+		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
 	defer cancel()
 
 	return s.Shutdown(ctx)
 }
+
+// reload reads the configuration again and applies the settings that can
+// change while the server runs.
+func reload(cs *server.ChatServer, level *slog.LevelVar) (*config, error) {
+	next, err := loadConfig(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+	set, err := next.check()
+	if err != nil {
+		return nil, err
+	}
+	cs.SetOptions(set.options)
+	cs.SetRateLimits(set.limits)
+	level.Set(set.logLevel)
+	return next, nil
+}
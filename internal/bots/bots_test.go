@@ -0,0 +1,69 @@
+package bots
+
+import (
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+	"chatui/internal/server"
+)
+
+// post is a message a bot sent through its host.
+type post struct {
+	destination string
+	text        string
+}
+
+// fakeHost is a server.BotHost recording what bots post instead of sending
+// it to a hub.
+type fakeHost struct {
+	posts  chan post
+	joined []string
+}
+
+func newFakeHost() *fakeHost {
+	return &fakeHost{posts: make(chan post, 16)}
+}
+
+func (h *fakeHost) Post(destination string, text string) {
+	h.posts <- post{destination: destination, text: text}
+}
+
+func (h *fakeHost) Join(channel string) {
+	h.joined = append(h.joined, channel)
+}
+
+// next returns the next post, failing the test if none comes.
+func (h *fakeHost) next(t *testing.T) post {
+	t.Helper()
+	select {
+	case p := <-h.posts:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("the bot posted nothing")
+		return post{}
+	}
+}
+
+// none fails the test if the bot posted anything.
+func (h *fakeHost) none(t *testing.T) {
+	t.Helper()
+	select {
+	case p := <-h.posts:
+		t.Fatalf("unexpected post %+v", p)
+	default:
+	}
+}
+
+// run answers msg with the command of bot it starts with, the way the hub
+// does.
+func run(t *testing.T, bot server.Bot, msg message.ChatMessage, name string, args string) {
+	t.Helper()
+	for _, cmd := range bot.Commands() {
+		if cmd.Name == name {
+			cmd.Run(msg, args)
+			return
+		}
+	}
+	t.Fatalf("%s has no /%s command", bot.Name(), name)
+}
@@ -0,0 +1,91 @@
+// Package bots contains bots that can run inside the chat server.
+package bots
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	message "chatui/internal/protocol"
+	"chatui/internal/server"
+)
+
+// Limits of a single /roll, so the answer fits in a chat message.
+const (
+	maxDice  = 20
+	maxSides = 1000
+)
+
+// Dice answers /roll with the result of a dice roll.
+type Dice struct {
+	host server.BotHost
+}
+
+// CreateDice returns a dice bot.
+func CreateDice() *Dice {
+	return &Dice{}
+}
+
+func (d *Dice) Name() string {
+	return "dice"
+}
+
+func (d *Dice) Commands() []server.BotCommand {
+	return []server.BotCommand{{
+		Name:  "roll",
+		Usage: "/roll [NdM]",
+		Help:  "roll N dice with M sides, one six-sided die by default",
+		Run:   d.roll,
+	}}
+}
+
+func (d *Dice) Start(host server.BotHost) {
+	d.host = host
+}
+
+func (d *Dice) Observe(msg message.ChatMessage) {}
+
+func (d *Dice) roll(msg message.ChatMessage, args string) {
+	n, sides, err := parseDice(args)
+	if err != nil {
+		d.host.Post(server.ReplyDestination(msg), err.Error())
+		return
+	}
+
+	rolls := make([]string, n)
+	total := 0
+	for i := range rolls {
+		roll := rand.IntN(sides) + 1
+		total += roll
+		rolls[i] = strconv.Itoa(roll)
+	}
+
+	text := fmt.Sprintf("%s rolled %dd%d: %d", msg.Username, n, sides, total)
+	if n > 1 {
+		text += " (" + strings.Join(rolls, " + ") + ")"
+	}
+	d.host.Post(server.ReplyDestination(msg), text)
+}
+
+// parseDice parses dice written as NdM, where N may be left out.
+func parseDice(s string) (n int, sides int, err error) {
+	if s == "" {
+		return 1, 6, nil
+	}
+
+	count, faces, ok := strings.Cut(strings.ToLower(s), "d")
+	if !ok {
+		return 0, 0, fmt.Errorf("cannot read %q, try /roll 2d6", s)
+	}
+	n = 1
+	if count != "" {
+		if n, err = strconv.Atoi(count); err != nil || n < 1 || n > maxDice {
+			return 0, 0, fmt.Errorf("the number of dice must be between 1 and %d", maxDice)
+		}
+	}
+	if sides, err = strconv.Atoi(faces); err != nil || sides < 2 || sides > maxSides {
+		return 0, 0, fmt.Errorf("dice must have between 2 and %d sides", maxSides)
+	}
+	return n, sides, nil
+}
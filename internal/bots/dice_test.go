@@ -0,0 +1,96 @@
+package bots
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+
+	message "chatui/internal/protocol"
+)
+
+func TestParseDice(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		n, sides int
+		ok       bool
+	}{
+		{"", 1, 6, true},
+		{"d20", 1, 20, true},
+		{"2d6", 2, 6, true},
+		{"3D8", 3, 8, true},
+		{"20d1000", 20, 1000, true},
+		{"6", 0, 0, false},
+		{"0d6", 0, 0, false},
+		{"21d6", 0, 0, false},
+		{"2d1", 0, 0, false},
+		{"2d1001", 0, 0, false},
+		{"xd6", 0, 0, false},
+		{"2dx", 0, 0, false},
+	} {
+		n, sides, err := parseDice(tt.in)
+		if (err == nil) != tt.ok || n != tt.n || sides != tt.sides {
+			t.Errorf("parseDice(%q) = %d, %d, %v", tt.in, n, sides, err)
+		}
+	}
+}
+
+func TestDiceRoll(t *testing.T) {
+	host := newFakeHost()
+	dice := CreateDice()
+	dice.Start(host)
+
+	msg := message.ChatMessage{Username: "alice", Destination: "#games", Message: "/roll 3d6"}
+	run(t, dice, msg, "roll", "3d6")
+
+	p := host.next(t)
+	if p.destination != "#games" {
+		t.Errorf("answered in %q, want #games", p.destination)
+	}
+	m := regexp.MustCompile(`^alice rolled 3d6: (\d+) \((\d) \+ (\d) \+ (\d)\)$`).FindStringSubmatch(p.text)
+	if m == nil {
+		t.Fatalf("unexpected answer %q", p.text)
+	}
+	total, _ := strconv.Atoi(m[1])
+	sum := 0
+	for _, roll := range m[2:] {
+		n, _ := strconv.Atoi(roll)
+		if n < 1 || n > 6 {
+			t.Errorf("rolled %d on a six-sided die", n)
+		}
+		sum += n
+	}
+	if total != sum {
+		t.Errorf("total %d, but the dice add up to %d", total, sum)
+	}
+	host.none(t)
+}
+
+func TestDiceRollDirect(t *testing.T) {
+	host := newFakeHost()
+	dice := CreateDice()
+	dice.Start(host)
+
+	// A direct message to the bot is answered to its author.
+	run(t, dice, message.ChatMessage{Username: "alice", Destination: "dice", Message: "/roll"}, "roll", "")
+
+	p := host.next(t)
+	if p.destination != "alice" {
+		t.Errorf("answered to %q, want alice", p.destination)
+	}
+	if !regexp.MustCompile(`^alice rolled 1d6: [1-6]$`).MatchString(p.text) {
+		t.Errorf("unexpected answer %q", p.text)
+	}
+}
+
+func TestDiceRollInvalid(t *testing.T) {
+	host := newFakeHost()
+	dice := CreateDice()
+	dice.Start(host)
+
+	run(t, dice, message.ChatMessage{Username: "alice", Destination: "ALL", Message: "/roll lots"}, "roll", "lots")
+
+	p := host.next(t)
+	if want := `cannot read "lots", try /roll 2d6`; p.destination != "ALL" || p.text != want {
+		t.Errorf("answered %+v, want %q in ALL", p, want)
+	}
+}
@@ -0,0 +1,84 @@
+package bots
+
+import (
+	"fmt"
+	"time"
+
+	message "chatui/internal/protocol"
+	"chatui/internal/server"
+)
+
+// Standup posts a daily reminder in a channel and answers /standup with the
+// time of the next one.
+type Standup struct {
+	channel string
+	hour    int
+	minute  int
+	host    server.BotHost
+
+	// now and sleep are the clock the bot goes by, which tests replace.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// CreateStandup returns a bot reminding channel of the standup every day at
+// at, given as "15:04" in local time.
+func CreateStandup(channel string, at string) (*Standup, error) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid standup time %q, expected HH:MM", at)
+	}
+	if !message.IsChannel(channel) {
+		return nil, fmt.Errorf("invalid standup channel %q", channel)
+	}
+	return &Standup{
+		channel: channel,
+		hour:    t.Hour(),
+		minute:  t.Minute(),
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}, nil
+}
+
+func (s *Standup) Name() string {
+	return "standup"
+}
+
+func (s *Standup) Commands() []server.BotCommand {
+	return []server.BotCommand{{
+		Name:  "standup",
+		Usage: "/standup",
+		Help:  "show when the next standup reminder is posted",
+		Run:   s.next,
+	}}
+}
+
+func (s *Standup) Start(host server.BotHost) {
+	s.host = host
+	host.Join(s.channel)
+	go s.remind()
+}
+
+func (s *Standup) Observe(msg message.ChatMessage) {}
+
+func (s *Standup) remind() {
+	for {
+		now := s.now()
+		s.sleep(s.nextReminder(now).Sub(now))
+		s.host.Post(s.channel, "Time for the standup! What did you do yesterday, what will you do today, is anything blocking you?")
+	}
+}
+
+func (s *Standup) next(msg message.ChatMessage, args string) {
+	at := s.nextReminder(s.now())
+	s.host.Post(server.ReplyDestination(msg), fmt.Sprintf("Next standup reminder in %s at %s.", s.channel, at.Format("Mon 15:04")))
+}
+
+// nextReminder returns the first reminder time after now.
+func (s *Standup) nextReminder(now time.Time) time.Time {
+	at := time.Date(now.Year(), now.Month(), now.Day(), s.hour, s.minute, 0, 0, now.Location())
+	if !at.After(now) {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at
+}
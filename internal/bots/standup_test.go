@@ -0,0 +1,109 @@
+package bots
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+func TestCreateStandup(t *testing.T) {
+	if _, err := CreateStandup("#team", "25:00"); err == nil {
+		t.Error("accepted an invalid time")
+	}
+	if _, err := CreateStandup("team", "09:30"); err == nil {
+		t.Error("accepted a user as the channel")
+	}
+	if _, err := CreateStandup("ALL", "09:30"); err != nil {
+		t.Errorf("refused the lobby: %v", err)
+	}
+}
+
+func TestStandupNextReminder(t *testing.T) {
+	s, err := CreateStandup("#team", "09:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(d, h, m int) time.Time { return time.Date(2026, 3, d, h, m, 0, 0, time.UTC) }
+	for _, tt := range []struct {
+		now, want time.Time
+	}{
+		{day(2, 8, 0), day(2, 9, 30)},
+		{day(2, 9, 29), day(2, 9, 30)},
+		// A reminder due right now was just posted.
+		{day(2, 9, 30), day(3, 9, 30)},
+		{day(2, 23, 59), day(3, 9, 30)},
+		{day(31, 12, 0), time.Date(2026, 4, 1, 9, 30, 0, 0, time.UTC)},
+	} {
+		if got := s.nextReminder(tt.now); !got.Equal(tt.want) {
+			t.Errorf("nextReminder(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestStandupReminds(t *testing.T) {
+	s, err := CreateStandup("#team", "09:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clock only moves when the bot sleeps.
+	clock := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	slept := make(chan time.Duration)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	s.now = func() time.Time { return clock }
+	s.sleep = func(d time.Duration) {
+		select {
+		case slept <- d:
+			clock = clock.Add(d)
+		case <-stop:
+			runtime.Goexit()
+		}
+	}
+
+	host := newFakeHost()
+	s.Start(host)
+	if len(host.joined) != 1 || host.joined[0] != "#team" {
+		t.Errorf("the bot joined %v, want #team", host.joined)
+	}
+
+	// Every sleep is followed by a reminder, the first one on the day the
+	// bot started.
+	for i, want := range []time.Duration{30 * time.Minute, 24 * time.Hour} {
+		if d := <-slept; d != want {
+			t.Fatalf("sleep %d lasted %v, want %v", i, d, want)
+		}
+		p := host.next(t)
+		if p.destination != "#team" || !strings.HasPrefix(p.text, "Time for the standup!") {
+			t.Errorf("reminder %d was %+v", i, p)
+		}
+	}
+}
+
+func TestStandupCommand(t *testing.T) {
+	s, err := CreateStandup("#team", "09:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC) }
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	s.sleep = func(time.Duration) {
+		<-stop
+		runtime.Goexit()
+	}
+
+	host := newFakeHost()
+	s.Start(host)
+
+	run(t, s, message.ChatMessage{Username: "alice", Destination: "standup", Message: "/standup"}, "standup", "")
+
+	p := host.next(t)
+	if want := "Next standup reminder in #team at Tue 09:30."; p.destination != "alice" || p.text != want {
+		t.Errorf("answered %+v, want %q to alice", p, want)
+	}
+}
@@ -3,8 +3,14 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	message "chatui/internal/protocol"
@@ -14,29 +20,107 @@ import (
 )
 
 type ChatClient struct {
-	logf func(f string, v ...any)
+	log *slog.Logger
+	// tls, when set, makes the client connect over wss:// with it.
+	tls *tls.Config
 }
 
-func CreateChatClient(logf func(f string, v ...any)) *ChatClient {
+func CreateChatClient(logger *slog.Logger, tlsConfig *tls.Config) *ChatClient {
 	return &ChatClient{
-		logf: logf,
+		log: logger,
+		tls: tlsConfig,
 	}
 }
 
-func (cc ChatClient) Connect(addr string) *websocket.Conn {
+// DefaultPath is the URL path of the chat when the address names none.
+const DefaultPath = "/chat"
+
+// ServerURL returns the websocket URL of the chat at addr, which is either a
+// ws:// or wss:// URL, or a host and port optionally followed by a path, such
+// as "chat.example.com:443/ws". path is used when addr has none, and useTLS
+// picks wss:// for an address without a scheme.
+func ServerURL(addr string, path string, useTLS bool) (string, error) {
+	scheme := "ws"
+	if useTLS {
+		scheme = "wss"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = scheme + "://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid server address: %w", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return "", fmt.Errorf("invalid server address %q: the scheme must be ws:// or wss://", addr)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid server address %q: no host", addr)
+	}
+	if useTLS && u.Scheme == "ws" {
+		return "", fmt.Errorf("server address %q is not wss:// but TLS was asked for", addr)
+	}
+	if u.Path == "" {
+		if !strings.HasPrefix(path, "/") {
+			return "", fmt.Errorf("invalid path %q: it must start with a slash", path)
+		}
+		u.Path = path
+	}
+	return u.String(), nil
+}
+
+// Connect dials the chat at serverURL, as returned by ServerURL, and says
+// hello.
+func (cc ChatClient) Connect(serverURL string) *websocket.Conn {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 
 	defer cancel()
 
-	c, _, err := websocket.Dial(ctx, "ws://"+addr+"/chat", nil)
+	var opts *websocket.DialOptions
+	if cc.tls != nil {
+		opts = &websocket.DialOptions{
+			HTTPClient: &http.Client{
+				Transport: &http.Transport{TLSClientConfig: cc.tls},
+			},
+		}
+	}
+
+	c, _, err := websocket.Dial(ctx, serverURL, opts)
 	if err != nil {
-		cc.logf("websocket dial error: %v", err)
+		cc.log.Error("failed to connect", "url", serverURL, "err", err)
+		return nil
+	}
+
+	envelope := message.MakeEnvelope(message.TypeHello, message.Hello{
+		Version:      message.ProtocolVersion,
+		Capabilities: message.Capabilities,
+	})
+	if err := wsjson.Write(ctx, c, envelope); err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		c.CloseNow()
 		return nil
 	}
 
 	return c
 }
 
+const (
+	reconnectBaseDelay = time.Millisecond * 500
+	reconnectMaxDelay  = time.Second * 30
+)
+
+// ReconnectDelay returns how long to wait before the given reconnect attempt.
+// The delay doubles with every attempt up to a maximum, with some jitter so
+// clients dropped at the same time do not all come back at once.
+func ReconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = min(reconnectBaseDelay<<attempt, reconnectMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
 func (cc ChatClient) Disconnect(c *websocket.Conn) {
 	c.Close(websocket.StatusNormalClosure, "client disconnecting")
 }
@@ -44,61 +128,253 @@ func (cc ChatClient) Disconnect(c *websocket.Conn) {
 func (cc ChatClient) Close(c *websocket.Conn) {
 	err := c.Close(websocket.StatusNormalClosure, "")
 	if err != nil {
-		cc.logf("websocket close error: %v", err)
+		cc.log.Warn("failed to close connection", "err", err)
 		return
 	}
 }
 
-func (cc ChatClient) SendMessage(c *websocket.Conn, msg string, destination string) {
-	sendMsg := message.ChatMessage{
+// SendMessage sends msg to destination, as a reply in the thread of
+// parentID unless it is empty. requestID is echoed back by the server on the
+// resulting chat message or error.
+func (cc ChatClient) SendMessage(c *websocket.Conn, msg string, destination string, parentID string, requestID string) {
+	cc.sendChat(c, message.ChatMessage{
 		Destination: destination,
 		Message:     msg,
-	}
+		ParentID:    parentID,
+	}, requestID)
+}
+
+// SendAction is like SendMessage for a "/me" action.
+func (cc ChatClient) SendAction(c *websocket.Conn, action string, destination string, parentID string, requestID string) {
+	cc.sendChat(c, message.ChatMessage{
+		Destination: destination,
+		Message:     action,
+		ParentID:    parentID,
+		Action:      true,
+	}, requestID)
+}
 
-	envelope := message.MakeEnvelope(message.TypeChatMessage, sendMsg)
+func (cc ChatClient) sendChat(c *websocket.Conn, sendMsg message.ChatMessage, requestID string) {
+	envelope := message.MakeReply(requestID, message.TypeChatMessage, sendMsg)
 
 	err := wsjson.Write(context.Background(), c, envelope)
 	if err != nil {
-		cc.logf("json data write error: %v", err)
+		cc.log.Error("failed to write envelope", "err", err)
 		return
 	}
 }
 
-func (cc ChatClient) SetUsername(c *websocket.Conn, username string) {
-	msg := message.LoginRequest{
+// Login authenticates as username with password. When register is set, a
+// new account is created instead.
+func (cc ChatClient) Login(c *websocket.Conn, username string, password string, register bool) {
+	cc.sendLogin(c, message.LoginRequest{
 		Username: username,
-	}
+		Password: password,
+		Register: register,
+	})
+}
 
+// LoginWithToken authenticates with a session token from an earlier login.
+// lastSeq is the sequence number of the newest message received before the
+// connection dropped; the server replays everything after it.
+func (cc ChatClient) LoginWithToken(c *websocket.Conn, username string, token string, lastSeq uint64) {
+	cc.sendLogin(c, message.LoginRequest{
+		Username: username,
+		Token:    token,
+		LastSeq:  lastSeq,
+	})
+}
+
+func (cc ChatClient) sendLogin(c *websocket.Conn, msg message.LoginRequest) {
 	envelope := message.MakeEnvelope(message.TypeLoginRequest, msg)
 
 	err := wsjson.Write(context.Background(), c, envelope)
 	if err != nil {
-		cc.logf("json data write error: %v", err)
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// SendTyping tells the other members of destination that the user is typing.
+func (cc ChatClient) SendTyping(c *websocket.Conn, destination string) {
+	envelope := message.MakeEnvelope(message.TypeTyping, message.Typing{Destination: destination})
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
 		return
 	}
 }
 
-func (cc ChatClient) ReceiveMessage(c *websocket.Conn, ctx context.Context) (any, error) {
+// SendReadReceipt tells sender that every direct message they sent up to and
+// including messageID has been read.
+func (cc ChatClient) SendReadReceipt(c *websocket.Conn, sender string, messageID string) {
+	envelope := message.MakeEnvelope(message.TypeReceipt, message.Receipt{
+		MessageID: messageID,
+		Sender:    sender,
+		Status:    message.ReceiptRead,
+	})
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// ChannelRequest sends a create, join, leave or list request for channel.
+func (cc ChatClient) ChannelRequest(c *websocket.Conn, kind message.MessageType, channel string, requestID string) {
+	envelope := message.MakeReply(requestID, kind, message.ChannelRequest{Channel: channel})
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// EditMessage replaces the text of the message with the given ID.
+func (cc ChatClient) EditMessage(c *websocket.Conn, id string, msg string, requestID string) {
+	envelope := message.MakeReply(requestID, message.TypeMessageEdit, message.MessageEdit{ID: id, Message: msg})
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// DeleteMessage removes the message with the given ID.
+func (cc ChatClient) DeleteMessage(c *websocket.Conn, id string, requestID string) {
+	envelope := message.MakeReply(requestID, message.TypeMessageDelete, message.MessageDelete{ID: id})
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// SendReaction adds emoji to the message with the given ID or, with remove,
+// takes it back.
+func (cc ChatClient) SendReaction(c *websocket.Conn, messageID string, emoji string, remove bool, requestID string) {
+	envelope := message.MakeReply(requestID, message.TypeReaction, message.Reaction{
+		MessageID: messageID,
+		Emoji:     emoji,
+		Remove:    remove,
+	})
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// RequestThread asks for the replies to the message parentID.
+func (cc ChatClient) RequestThread(c *websocket.Conn, parentID string, requestID string) {
+	envelope := message.MakeReply(requestID, message.TypeThread, message.ThreadRequest{ParentID: parentID})
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// Moderate asks the server to take a moderation action.
+func (cc ChatClient) Moderate(c *websocket.Conn, req message.Moderation, requestID string) {
+	envelope := message.MakeReply(requestID, message.TypeModeration, req)
+
+	err := wsjson.Write(context.Background(), c, envelope)
+	if err != nil {
+		cc.log.Error("failed to write envelope", "err", err)
+		return
+	}
+}
+
+// ReceiveMessage reads the next envelope and decodes its payload. It also
+// returns the request ID the server echoed, if any. Envelopes of types this
+// client does not know are skipped.
+func (cc ChatClient) ReceiveMessage(c *websocket.Conn, ctx context.Context) (any, string, error) {
+	for {
+		msg, requestID, known, err := cc.receiveEnvelope(c, ctx)
+		if err != nil || known {
+			return msg, requestID, err
+		}
+	}
+}
+
+func (cc ChatClient) receiveEnvelope(c *websocket.Conn, ctx context.Context) (any, string, bool, error) {
 	var envelope message.Envelope
 	err := wsjson.Read(ctx, c, &envelope)
 	if err != nil {
-		return nil, err
+		return nil, "", false, err
 	}
 
 	switch envelope.Type {
 	case message.TypeChatMessage:
 		var msg message.ChatMessage
 		json.Unmarshal(envelope.Data, &msg)
-		return msg, nil
+		return msg, envelope.RequestID, true, nil
 	case message.TypeLoginResponse:
 		var msg message.LoginResponse
 		json.Unmarshal(envelope.Data, &msg)
-		return msg, nil
+		return msg, envelope.RequestID, true, nil
 	case message.TypeUserListUpdate:
 		var msg message.UserListUpdate
 		json.Unmarshal(envelope.Data, &msg)
-		return msg, nil
+		return msg, envelope.RequestID, true, nil
+	case message.TypeChannelList:
+		var msg message.ChannelList
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeChannelResponse:
+		var msg message.ChannelResponse
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeTyping:
+		var msg message.Typing
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeReceipt:
+		var msg message.Receipt
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeError:
+		var msg message.Error
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeHistory:
+		var msg message.History
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeMessageEdit:
+		var msg message.MessageEdit
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeMessageDelete:
+		var msg message.MessageDelete
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeReaction:
+		var msg message.Reaction
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeThread:
+		var msg message.Thread
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeHello:
+		var msg message.Hello
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
+	case message.TypeNotice:
+		var msg message.Notice
+		json.Unmarshal(envelope.Data, &msg)
+		return msg, envelope.RequestID, true, nil
 	default:
-		return nil, fmt.Errorf("unknown message type: %s", envelope.Type)
+		cc.log.Debug("skipping unknown message type", "type", envelope.Type)
+		return nil, envelope.RequestID, false, nil
 	}
 }
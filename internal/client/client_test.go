@@ -0,0 +1,40 @@
+package client
+
+import "testing"
+
+func TestServerURL(t *testing.T) {
+	for _, tt := range []struct {
+		addr   string
+		path   string
+		useTLS bool
+		want   string
+	}{
+		{"localhost:8080", DefaultPath, false, "ws://localhost:8080/chat"},
+		{"localhost:8080", "/", false, "ws://localhost:8080/"},
+		{"chat.example.com:443", "/ws", true, "wss://chat.example.com:443/ws"},
+		{"localhost:8080/ws", DefaultPath, false, "ws://localhost:8080/ws"},
+		{"ws://localhost:8080", "/ws", false, "ws://localhost:8080/ws"},
+		{"wss://chat.example.com/rooms/chat", DefaultPath, false, "wss://chat.example.com/rooms/chat"},
+		{"wss://chat.example.com/", DefaultPath, true, "wss://chat.example.com/"},
+	} {
+		got, err := ServerURL(tt.addr, tt.path, tt.useTLS)
+		if err != nil || got != tt.want {
+			t.Errorf("ServerURL(%q, %q, %v) = %q, %v, want %q", tt.addr, tt.path, tt.useTLS, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		addr   string
+		path   string
+		useTLS bool
+	}{
+		{"http://localhost:8080", DefaultPath, false},
+		{"ws://", DefaultPath, false},
+		{"ws://localhost:8080", DefaultPath, true},
+		{"localhost:8080", "chat", false},
+	} {
+		if got, err := ServerURL(tt.addr, tt.path, tt.useTLS); err == nil {
+			t.Errorf("ServerURL(%q, %q, %v) = %q, want an error", tt.addr, tt.path, tt.useTLS, got)
+		}
+	}
+}
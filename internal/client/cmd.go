@@ -2,7 +2,6 @@ package client
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	message "chatui/internal/protocol"
@@ -15,34 +14,100 @@ func connectCmd(cc *ChatClient, addr string) tea.Cmd {
 	return func() tea.Msg {
 		conn := cc.Connect(addr)
 		if conn == nil {
-			return errorMsg{err: fmt.Errorf("failed to connect to server")}
+			return connectAttemptMsg{attempt: 0}
 		}
 
 		return connectedMsg{conn: conn, username: "User"}
 	}
 }
 
-func setUsernameCmd(cc *ChatClient, conn *websocket.Conn, username string) tea.Cmd {
+// reconnectCmd waits for the backoff delay of attempt and dials again.
+func reconnectCmd(cc *ChatClient, addr string, attempt int) tea.Cmd {
 	return func() tea.Msg {
-		cc.SetUsername(conn, username)
+		time.Sleep(ReconnectDelay(attempt))
+		return connectAttemptMsg{conn: cc.Connect(addr), attempt: attempt}
+	}
+}
+
+func resumeCmd(cc *ChatClient, conn *websocket.Conn, username string, token string, lastSeq uint64) tea.Cmd {
+	return func() tea.Msg {
+		cc.LoginWithToken(conn, username, token, lastSeq)
+		return nil
+	}
+}
+
+// saveTokenCmd stores the session token of username in a saved profile.
+func saveTokenCmd(cfg *Config, profile string, username string, token string) tea.Cmd {
+	return func() tea.Msg {
+		if err := cfg.SaveToken(profile, username, token); err != nil {
+			return errorMsg{err: err}
+		}
+		return nil
+	}
+}
+
+func loginCmd(cc *ChatClient, conn *websocket.Conn, username string, password string, register bool) tea.Cmd {
+	return func() tea.Msg {
+		cc.Login(conn, username, password, register)
 		return nil
 	}
 }
 
 func listenCmd(cc *ChatClient, conn *websocket.Conn) tea.Cmd {
 	return func() tea.Msg {
-		msg, err := cc.ReceiveMessage(conn, context.Background())
+		msg, requestID, err := cc.ReceiveMessage(conn, context.Background())
 		if err != nil {
-			return errorMsg{err: err}
+			return disconnectedMsg{conn: conn, err: err}
 		}
 
 		switch msg := msg.(type) {
 		case message.ChatMessage:
-			return receivedMsg{username: msg.Username, content: msg.Message, destination: msg.Destination}
+			received := toReceivedMsg(msg)
+			received.requestID = requestID
+			return received
+		case message.MessageEdit:
+			return messageChangeMsg{requestID: requestID, id: msg.ID, username: msg.Username, destination: msg.Destination, content: msg.Message}
+		case message.MessageDelete:
+			return messageChangeMsg{requestID: requestID, id: msg.ID, username: msg.Username, destination: msg.Destination, deleted: true}
+		case message.Reaction:
+			return reactionMsg{requestID: requestID, messageID: msg.MessageID, author: msg.Author, destination: msg.Destination, reactions: msg.Reactions}
+		case message.Thread:
+			thread := threadMsg{requestID: requestID, parent: toReceivedMsg(msg.Parent)}
+			for _, m := range msg.Replies {
+				thread.replies = append(thread.replies, toReceivedMsg(m))
+			}
+			return thread
+		case message.Notice:
+			return noticeMsg{requestID: requestID, text: msg.Message}
+		case message.Hello:
+			return helloMsg{version: msg.Version, capabilities: msg.Capabilities, commands: msg.Commands, maxLength: msg.MaxMessageLength}
+		case message.Error:
+			return serverErrorMsg{requestID: requestID, code: msg.Code, message: msg.Message}
 		case message.LoginResponse:
-			return loginMsg{success: msg.Success, message: msg.Message}
+			return loginMsg{success: msg.Success, message: msg.Message, username: msg.Username, token: msg.Token}
 		case message.UserListUpdate:
 			return userListMsg{users: msg.Users}
+		case message.ChannelList:
+			list := channelListMsg{}
+			for _, channel := range msg.Channels {
+				list.available = append(list.available, channel.Name)
+				if channel.Joined {
+					list.joined = append(list.joined, channel.Name)
+				}
+			}
+			return list
+		case message.Typing:
+			return typingMsg{username: msg.Username, destination: msg.Destination}
+		case message.Receipt:
+			return receiptMsg{messageID: msg.MessageID, reader: msg.Reader, status: msg.Status}
+		case message.ChannelResponse:
+			return channelResponseMsg{requestID: requestID, channel: msg.Channel, success: msg.Success, message: msg.Message}
+		case message.History:
+			history := historyMsg{}
+			for _, m := range msg.Messages {
+				history.messages = append(history.messages, toReceivedMsg(m))
+			}
+			return history
 
 		default:
 			return nil
@@ -50,13 +115,105 @@ func listenCmd(cc *ChatClient, conn *websocket.Conn) tea.Cmd {
 	}
 }
 
-func sendCmd(cc *ChatClient, conn *websocket.Conn, content string, destination string) tea.Cmd {
+func toReceivedMsg(msg message.ChatMessage) receivedMsg {
+	return receivedMsg{
+		id:          msg.ID,
+		username:    msg.Username,
+		content:     msg.Message,
+		destination: msg.Destination,
+		timestamp:   msg.Timestamp,
+		seq:         msg.Seq,
+		edited:      msg.Edited,
+		deleted:     msg.Deleted,
+		reactions:   msg.Reactions,
+		parentID:    msg.ParentID,
+		replies:     msg.Replies,
+		members:     msg.ThreadMembers,
+		action:      msg.Action,
+	}
+}
+
+func sendCmd(cc *ChatClient, conn *websocket.Conn, content string, destination string, parentID string, requestID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.SendMessage(conn, content, destination, parentID, requestID)
+		return nil
+	}
+}
+
+func actionCmd(cc *ChatClient, conn *websocket.Conn, action string, destination string, parentID string, requestID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.SendAction(conn, action, destination, parentID, requestID)
+		return nil
+	}
+}
+
+func editCmd(cc *ChatClient, conn *websocket.Conn, id string, content string, requestID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.EditMessage(conn, id, content, requestID)
+		return nil
+	}
+}
+
+func deleteCmd(cc *ChatClient, conn *websocket.Conn, id string, requestID string) tea.Cmd {
 	return func() tea.Msg {
-		cc.SendMessage(conn, content, destination)
+		cc.DeleteMessage(conn, id, requestID)
 		return nil
 	}
 }
 
+func reactionCmd(cc *ChatClient, conn *websocket.Conn, messageID string, emoji string, remove bool, requestID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.SendReaction(conn, messageID, emoji, remove, requestID)
+		return nil
+	}
+}
+
+func threadCmd(cc *ChatClient, conn *websocket.Conn, parentID string, requestID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.RequestThread(conn, parentID, requestID)
+		return nil
+	}
+}
+
+func moderationCmd(cc *ChatClient, conn *websocket.Conn, req message.Moderation, requestID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.Moderate(conn, req, requestID)
+		return nil
+	}
+}
+
+func channelCmd(cc *ChatClient, conn *websocket.Conn, kind message.MessageType, channel string, requestID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.ChannelRequest(conn, kind, channel, requestID)
+		return nil
+	}
+}
+
+func typingCmd(cc *ChatClient, conn *websocket.Conn, destination string) tea.Cmd {
+	return func() tea.Msg {
+		cc.SendTyping(conn, destination)
+		return nil
+	}
+}
+
+func readReceiptCmd(cc *ChatClient, conn *websocket.Conn, sender string, messageID string) tea.Cmd {
+	return func() tea.Msg {
+		cc.SendReadReceipt(conn, sender, messageID)
+		return nil
+	}
+}
+
+// typingExpiryCmd fires once a typing notification received now has gone
+// stale.
+func typingExpiryCmd() tea.Cmd {
+	return tea.Tick(message.TypingTimeout, func(t time.Time) tea.Msg { return typingExpiredMsg{} })
+}
+
+// clockCmd refreshes relative timestamps periodically.
+func clockCmd() tea.Cmd {
+	return tea.Tick(time.Second*30, func(t time.Time) tea.Msg { return clockMsg{} })
+}
+
 func blinkCmd() tea.Cmd {
 	return tea.Tick(time.Millisecond*150, func(t time.Time) tea.Msg { return blinkMsg{} })
 }
@@ -0,0 +1,422 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	message "chatui/internal/protocol"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// command is a slash command typed in the chat input, such as "/join #go".
+type command struct {
+	name string
+	// args names the arguments for the usage line. Optional ones are in
+	// brackets, and a name ending in "..." takes the rest of the line.
+	args []string
+	help string
+	// complete returns the candidates for the argument at index i. It may
+	// be nil for commands without completable arguments.
+	complete func(m *model, i int) []string
+	run      func(m *model, args []string) (tea.Cmd, error)
+}
+
+// commands is the registry of slash commands, in the order /help lists them.
+// Adding a command only takes a new entry here.
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "msg", args: []string{"<user>", "<text...>"}, help: "send a private message", complete: completeUsers, run: runMsg},
+		{name: "me", args: []string{"<action...>"}, help: "describe what you are doing", run: runMe},
+		{name: "join", args: []string{"<#channel>"}, help: "join a channel", complete: completeChannels(false), run: runChannelOp(message.TypeChannelJoin)},
+		{name: "create", args: []string{"<#channel>"}, help: "create a channel", run: runChannelOp(message.TypeChannelCreate)},
+		{name: "leave", args: []string{"[#channel]"}, help: "leave a channel, the current one by default", complete: completeChannels(true), run: runChannelOp(message.TypeChannelLeave)},
+		{name: "channels", help: "list the channels", run: runChannels},
+		{name: "kick", args: []string{"<user>", "[reason...]"}, help: "disconnect a user (moderators)", complete: completeUsers, run: runModeration(message.ModerationKick)},
+		{name: "mute", args: []string{"<user>", "[duration]", "[reason...]"}, help: "stop a user from sending messages, 10m by default (moderators)", complete: completeUsers, run: runModeration(message.ModerationMute)},
+		{name: "unmute", args: []string{"<user>"}, help: "let a muted user talk again (moderators)", complete: completeUsers, run: runModeration(message.ModerationUnmute)},
+		{name: "ban", args: []string{"<user|ip>", "[duration]", "[reason...]"}, help: "keep a user or IP address out, for good by default (admins)", complete: completeUsers, run: runModeration(message.ModerationBan)},
+		{name: "unban", args: []string{"<user|ip>"}, help: "lift a ban (admins)", run: runModeration(message.ModerationUnban)},
+		{name: "role", args: []string{"<user>", "<role>"}, help: "make a user an admin, a moderator or a plain user (admins)", complete: completeRoles, run: runModeration(message.ModerationRole)},
+		{name: "nick", args: []string{"<name>"}, help: "log out and log in again as another user", run: runNick},
+		{name: "clear", help: "clear the current conversation", run: runClear},
+		{name: "help", args: []string{"[command]"}, help: "show this help", complete: completeCommands, run: runHelp},
+		{name: "quit", help: "exit the chat", run: runQuit},
+	}
+}
+
+// errUsage is returned by a command given the wrong arguments; the usage
+// line is shown instead of the error.
+var errUsage = errors.New("usage")
+
+func findCommand(name string) (command, bool) {
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == name })
+	if i < 0 {
+		return command{}, false
+	}
+	return commands[i], true
+}
+
+func (c command) usage() string {
+	return strings.TrimSpace("/" + c.name + " " + strings.Join(c.args, " "))
+}
+
+// required returns how many arguments must be given.
+func (c command) required() int {
+	n := 0
+	for _, arg := range c.args {
+		if !strings.HasPrefix(arg, "[") {
+			n++
+		}
+	}
+	return n
+}
+
+// parseArgs splits what follows the command name into its arguments. The
+// last argument of c takes the rest of the line if its name ends in "...".
+func (c command) parseArgs(rest string) []string {
+	var args []string
+	for i := range c.args {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		if i == len(c.args)-1 && strings.HasSuffix(strings.Trim(c.args[i], "<>[]"), "...") {
+			args = append(args, strings.TrimSpace(rest))
+			break
+		}
+		arg, after, _ := strings.Cut(rest, " ")
+		args = append(args, arg)
+		rest = after
+	}
+	return args
+}
+
+// runCommand runs the slash command on line, reporting problems as local
+// messages in the active conversation.
+func (m *model) runCommand(line string) tea.Cmd {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	c, ok := findCommand(name)
+	if !ok {
+		if _, ok := m.findServerCommand(name); ok {
+			return m.runServerCommand(line)
+		}
+		m.addSystemMessage(fmt.Sprintf("Unknown command /%s, try /help", name))
+		return nil
+	}
+
+	args := c.parseArgs(rest)
+	if len(args) < c.required() {
+		m.addSystemMessage("Usage: " + c.usage())
+		return nil
+	}
+
+	cmd, err := c.run(m, args)
+	if errors.Is(err, errUsage) {
+		m.addSystemMessage("Usage: " + c.usage())
+	} else if err != nil {
+		m.addSystemMessage("/" + c.name + ": " + err.Error())
+	}
+	return cmd
+}
+
+// completeCommand completes the command name or argument being typed in
+// line. It returns the completed line and, when the completion is ambiguous,
+// the candidates.
+func (m *model) completeCommand(line string) (string, []string) {
+	name, rest, hasArgs := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	if !hasArgs {
+		completed, candidates := complete(name, completeCommands(m, 0))
+		if len(candidates) == 1 {
+			return "/" + completed + " ", nil
+		}
+		return "/" + completed, prefixAll("/", candidates)
+	}
+
+	c, ok := findCommand(name)
+	if !ok || c.complete == nil {
+		return line, nil
+	}
+
+	// Only the last word is completed, and never inside a free text argument.
+	words := strings.Split(rest, " ")
+	i := len(words) - 1
+	if i >= len(c.args) || strings.HasSuffix(strings.Trim(c.args[i], "<>[]"), "...") {
+		return line, nil
+	}
+
+	completed, candidates := complete(words[i], c.complete(m, i))
+	words[i] = completed
+	line = "/" + name + " " + strings.Join(words, " ")
+	if len(candidates) == 1 {
+		return line + " ", nil
+	}
+	return line, candidates
+}
+
+// complete returns the candidates starting with prefix and the longest prefix
+// they share.
+func complete(prefix string, options []string) (string, []string) {
+	var candidates []string
+	for _, option := range options {
+		if strings.HasPrefix(option, prefix) {
+			candidates = append(candidates, option)
+		}
+	}
+	if len(candidates) == 0 {
+		return prefix, nil
+	}
+
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	return common, candidates
+}
+
+func prefixAll(prefix string, values []string) []string {
+	prefixed := make([]string, len(values))
+	for i, value := range values {
+		prefixed[i] = prefix + value
+	}
+	return prefixed
+}
+
+func completeUsers(m *model, i int) []string {
+	if i != 0 {
+		return nil
+	}
+	return m.currentUsers
+}
+
+// completeChannels completes channel names, the joined ones or the others.
+func completeChannels(joined bool) func(m *model, i int) []string {
+	return func(m *model, i int) []string {
+		var names []string
+		for _, channel := range m.availableChannels {
+			if slices.Contains(m.channels, channel) == joined && channel != message.LobbyChannel {
+				names = append(names, channel)
+			}
+		}
+		return names
+	}
+}
+
+func completeRoles(m *model, i int) []string {
+	if i == 0 {
+		return m.currentUsers
+	}
+	return []string{string(message.RoleUser), string(message.RoleModerator), string(message.RoleAdmin)}
+}
+
+func completeCommands(m *model, i int) []string {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	for _, c := range m.serverCommands {
+		if _, ok := findCommand(c.Name); !ok {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// findServerCommand looks up a command answered by a bot on the server.
+// Commands of the client take precedence over them.
+func (m *model) findServerCommand(name string) (message.CommandInfo, bool) {
+	i := slices.IndexFunc(m.serverCommands, func(c message.CommandInfo) bool { return c.Name == name })
+	if i < 0 {
+		return message.CommandInfo{}, false
+	}
+	return m.serverCommands[i], true
+}
+
+// runServerCommand sends line as a chat message to the active conversation,
+// where the bot answering it will see it.
+func (m *model) runServerCommand(line string) tea.Cmd {
+	if err := m.connected(); err != nil {
+		m.addSystemMessage(line + ": " + err.Error())
+		return nil
+	}
+	requestID := m.newRequest(m.activeTab())
+	return sendCmd(m.chatClient, m.conn, line, m.activeTab(), m.thread, requestID)
+}
+
+func serverCommandUsage(c message.CommandInfo) string {
+	usage := c.Usage
+	if usage == "" {
+		usage = "/" + c.Name
+	}
+	return usage + " — " + c.Help
+}
+
+// connected returns an error when messages cannot be sent to the server.
+func (m *model) connected() error {
+	if m.conn == nil || m.reconnecting {
+		return errors.New("not connected to the server")
+	}
+	return nil
+}
+
+func runMsg(m *model, args []string) (tea.Cmd, error) {
+	if err := m.connected(); err != nil {
+		return nil, err
+	}
+	user, text := args[0], args[1]
+	if message.IsChannel(user) {
+		return nil, errors.New("use /join to talk in a channel")
+	}
+
+	if slices.Contains(m.currentUsers, user) {
+		m.selectTab(user)
+	}
+	requestID := m.newRequest(m.activeTab())
+	return sendCmd(m.chatClient, m.conn, text, user, "", requestID), nil
+}
+
+func runMe(m *model, args []string) (tea.Cmd, error) {
+	if err := m.connected(); err != nil {
+		return nil, err
+	}
+	requestID := m.newRequest(m.activeTab())
+	return actionCmd(m.chatClient, m.conn, args[0], m.activeTab(), m.thread, requestID), nil
+}
+
+// runChannelOp returns the command creating, joining or leaving a channel.
+func runChannelOp(kind message.MessageType) func(m *model, args []string) (tea.Cmd, error) {
+	return func(m *model, args []string) (tea.Cmd, error) {
+		if err := m.connected(); err != nil {
+			return nil, err
+		}
+		if !m.supports(message.CapChannels) {
+			return nil, errors.New("channels are not supported by this server")
+		}
+
+		var channel string
+		if len(args) > 0 {
+			channel = args[0]
+			if !strings.HasPrefix(channel, message.ChannelPrefix) {
+				channel = message.ChannelPrefix + channel
+			}
+		} else if message.IsChannel(m.activeTab()) {
+			channel = m.activeTab()
+		} else {
+			return nil, errUsage
+		}
+
+		if kind != message.TypeChannelLeave {
+			m.pendingChannel = channel
+		}
+		requestID := m.newRequest(m.activeTab())
+		return channelCmd(m.chatClient, m.conn, kind, channel, requestID), nil
+	}
+}
+
+// runModeration returns the command sending a moderation request. Mutes and
+// bans take an optional duration before the reason.
+func runModeration(action message.ModerationAction) func(m *model, args []string) (tea.Cmd, error) {
+	return func(m *model, args []string) (tea.Cmd, error) {
+		if err := m.connected(); err != nil {
+			return nil, err
+		}
+		if !m.supports(message.CapModeration) {
+			return nil, errors.New("moderation is not supported by this server")
+		}
+
+		req := message.Moderation{Action: action, Target: args[0]}
+		rest := args[1:]
+		switch action {
+		case message.ModerationRole:
+			req.Role = message.Role(rest[0])
+			rest = nil
+		case message.ModerationMute, message.ModerationBan:
+			if len(rest) > 0 {
+				if _, err := time.ParseDuration(rest[0]); err == nil {
+					req.Duration = rest[0]
+					rest = rest[1:]
+				}
+			}
+		}
+		req.Reason = strings.Join(rest, " ")
+
+		requestID := m.newRequest(m.activeTab())
+		return moderationCmd(m.chatClient, m.conn, req, requestID), nil
+	}
+}
+
+func runChannels(m *model, args []string) (tea.Cmd, error) {
+	m.addSystemMessage("Channels: " + strings.Join(m.availableChannels, ", "))
+	return nil, nil
+}
+
+func runNick(m *model, args []string) (tea.Cmd, error) {
+	name := args[0]
+	if name == m.username {
+		return nil, errors.New("you are already " + name)
+	}
+
+	var cmd tea.Cmd
+	if m.conn != nil {
+		m.chatClient.Disconnect(m.conn)
+		cmd = connectCmd(m.chatClient, m.address)
+	}
+	m.logout()
+	m.usernameInput.SetValue(name)
+	m.loginField = LoginFieldPassword
+	m.usernameInput.Blur()
+	m.loginHelper = "Log in as " + name + ", or press Ctrl+R to create the account"
+	return tea.Batch(cmd, m.passwordInput.Focus()), nil
+}
+
+func runClear(m *model, args []string) (tea.Cmd, error) {
+	tab := m.activeTab()
+	if m.thread != "" {
+		m.closeThread()
+	}
+	delete(m.messages, tab)
+	m.viewport.SetContent("")
+	return nil, nil
+}
+
+func runHelp(m *model, args []string) (tea.Cmd, error) {
+	if len(args) > 0 {
+		name := strings.TrimPrefix(args[0], "/")
+		c, ok := findCommand(name)
+		if !ok {
+			if sc, ok := m.findServerCommand(name); ok {
+				m.addSystemMessage(serverCommandUsage(sc))
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown command /%s", name)
+		}
+		m.addSystemMessage(c.usage() + " — " + c.help)
+		return nil, nil
+	}
+
+	m.addSystemMessage("Commands (Tab completes, start a message with // to send a leading /):")
+	for _, c := range commands {
+		m.addSystemMessage(c.usage() + " — " + c.help)
+	}
+	if len(m.serverCommands) > 0 {
+		m.addSystemMessage("Commands answered by the server:")
+		for _, c := range m.serverCommands {
+			m.addSystemMessage(serverCommandUsage(c))
+		}
+	}
+	return nil, nil
+}
+
+func runQuit(m *model, args []string) (tea.Cmd, error) {
+	if m.conn != nil {
+		m.chatClient.Disconnect(m.conn)
+	}
+	return tea.Quit, nil
+}
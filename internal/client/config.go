@@ -0,0 +1,131 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Profile is a server the client can connect to by name, with what is
+// needed to log in without asking.
+type Profile struct {
+	// Address is the server's host and port, optionally followed by a path,
+	// or its ws:// or wss:// URL. Path is used when the address has none.
+	Address string `json:"address"`
+	Path    string `json:"path,omitempty"`
+	// Username, with Password or Token, logs in automatically. Token is
+	// the session token of an earlier login and is kept up to date by the
+	// client.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	TLS                bool   `json:"tls,omitempty"`
+	CA                 string `json:"ca,omitempty"`
+	Cert               string `json:"cert,omitempty"`
+	Key                string `json:"key,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// Config is the client configuration file, which holds the theme and the
+// saved profiles. It is safe to use from any goroutine.
+type Config struct {
+	path  string
+	theme string
+
+	mu       sync.Mutex
+	profiles map[string]Profile
+}
+
+type configFile struct {
+	// Theme is the name of a built-in theme or the path of a theme file.
+	Theme    string             `json:"theme,omitempty"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// DefaultConfigPath returns chatui/config.json in the user's configuration
+// directory, $XDG_CONFIG_HOME or ~/.config on Linux.
+func DefaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "chatui", "config.json")
+}
+
+// LoadConfig reads the configuration at path. A missing file is an empty
+// configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{path: path, profiles: make(map[string]Profile)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file configFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("reading config from %s: %w", path, err)
+	}
+	for name, profile := range file.Profiles {
+		if profile.Address == "" {
+			return nil, fmt.Errorf("profile %q in %s has no address", name, path)
+		}
+		cfg.profiles[name] = profile
+	}
+	cfg.theme = file.Theme
+	return cfg, nil
+}
+
+// Theme returns the theme chosen in the configuration, or "" for the
+// default. The path of a theme file is relative to the configuration.
+func (cfg *Config) Theme() string {
+	if _, ok := Themes[cfg.theme]; ok || cfg.theme == "" || filepath.IsAbs(cfg.theme) {
+		return cfg.theme
+	}
+	return filepath.Join(filepath.Dir(cfg.path), cfg.theme)
+}
+
+// Profile returns the profile called name.
+func (cfg *Config) Profile(name string) (Profile, bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	profile, ok := cfg.profiles[name]
+	return profile, ok
+}
+
+// SaveToken stores the session token username got from the server in the
+// profile called name, and writes the configuration back to its file.
+func (cfg *Config) SaveToken(name string, username string, token string) error {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	profile, ok := cfg.profiles[name]
+	if !ok || (profile.Username == username && profile.Token == token) {
+		return nil
+	}
+	profile.Username = username
+	profile.Token = token
+	cfg.profiles[name] = profile
+
+	data, err := json.MarshalIndent(configFile{Theme: cfg.theme, Profiles: cfg.profiles}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.path), 0o700); err != nil {
+		return err
+	}
+	// The file holds credentials, so only the user may read it.
+	tmp := cfg.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfg.path)
+}
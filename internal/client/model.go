@@ -1,7 +1,12 @@
 package client
 
 import (
-	"log"
+	"crypto/tls"
+	"log/slog"
+	"slices"
+	"time"
+
+	message "chatui/internal/protocol"
 
 	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/textinput"
@@ -17,13 +22,91 @@ type connectedMsg struct {
 }
 
 type receivedMsg struct {
+	requestID   string
+	id          string
 	username    string
 	destination string
 	content     string
+	timestamp   time.Time
+	seq         uint64
+	edited      bool
+	deleted     bool
+	reactions   map[string][]string
+	parentID    string
+	replies     int
+	members     []string
+	action      bool
+}
+
+// threadMsg carries a thread asked for with threadCmd.
+type threadMsg struct {
+	requestID string
+	parent    receivedMsg
+	replies   []receivedMsg
+}
+
+// noticeMsg is a message from the server itself, such as the outcome of a
+// moderation request.
+type noticeMsg struct {
+	requestID string
+	text      string
+}
+
+// reactionMsg carries the reactions of a message after someone reacted to it.
+type reactionMsg struct {
+	requestID   string
+	messageID   string
+	author      string
+	destination string
+	reactions   map[string][]string
+}
+
+// messageChangeMsg reports that a message was edited, or deleted.
+type messageChangeMsg struct {
+	requestID   string
+	id          string
+	username    string
+	destination string
+	content     string
+	deleted     bool
+}
+type typingMsg struct {
+	username    string
+	destination string
+}
+type typingExpiredMsg struct{}
+type receiptMsg struct {
+	messageID string
+	reader    string
+	status    message.ReceiptStatus
+}
+type historyMsg struct {
+	messages []receivedMsg
+}
+type channelListMsg struct {
+	joined    []string
+	available []string
+}
+type channelResponseMsg struct {
+	requestID string
+	channel   string
+	success   bool
+	message   string
 }
 type loginMsg struct {
-	success bool
-	message string
+	success  bool
+	message  string
+	username string
+	token    string
+}
+
+// helloMsg is the server's answer to our hello, with the capabilities both
+// sides support and the commands answered by the server's bots.
+type helloMsg struct {
+	version      int
+	capabilities []message.Capability
+	commands     []message.CommandInfo
+	maxLength    int
 }
 type userListMsg struct {
 	users []string
@@ -33,6 +116,26 @@ type errorMsg struct {
 	err error
 }
 
+// serverErrorMsg is an error envelope; requestID matches the request that
+// caused it.
+type serverErrorMsg struct {
+	requestID string
+	code      message.ErrorCode
+	message   string
+}
+
+// disconnectedMsg reports that reading from conn failed.
+type disconnectedMsg struct {
+	conn *websocket.Conn
+	err  error
+}
+
+// connectAttemptMsg carries the result of a dial; conn is nil if it failed.
+type connectAttemptMsg struct {
+	conn    *websocket.Conn
+	attempt int
+}
+
 type ViewState int
 
 const (
@@ -40,35 +143,104 @@ const (
 	ViewChat
 )
 
+type LoginField int
+
+const (
+	LoginFieldUsername LoginField = iota
+	LoginFieldPassword
+)
+
 type FocusState int
 
 const (
 	FocusChat FocusState = iota
 	FocusUserList
+	// FocusMessages picks a message in the viewport to react to.
+	FocusMessages
 )
 
+// reactionEmojis are offered, in order, by the number keys when reacting to
+// a message.
+var reactionEmojis = []string{"👍", "👎", "😂", "🎉", "😮", "👀"}
+
 type rawMessage struct {
-	username string
-	content  string
+	id string
+	// seq is the Seq the server gave the message, zero for system lines.
+	seq       uint64
+	username  string
+	content   string
+	timestamp time.Time
+	// status is the delivery state of a direct message we sent, empty
+	// until the server confirms it reached the recipient.
+	status message.ReceiptStatus
+	// system marks lines produced locally by the client, such as command
+	// feedback, rather than messages sent by a user.
+	system    bool
+	edited    bool
+	deleted   bool
+	reactions map[string][]string
+	// parentID is set on replies, which are only shown in the thread pane.
+	// replies and members are set on the message starting a thread.
+	parentID string
+	replies  int
+	members  []string
+	action   bool
 }
 
 type model struct {
 	// Login
 	usernameInput textinput.Model
+	passwordInput textinput.Model
+	loginField    LoginField
 	loginHelper   string
+	token         string
+	// config and profile name the saved profile the client was started
+	// with, whose token is kept up to date. autoLogin holds its saved
+	// credentials still to be tried before the login form is needed.
+	config    *Config
+	profile   string
+	autoLogin *Profile
 
-	// UserList
-	currentUsers     []string
-	currentSelection int
+	// Sidebar. The selection indexes the joined channels followed by the
+	// users, see tabs.
+	channels          []string
+	availableChannels []string
+	pendingChannel    string
+	currentUsers      []string
+	currentSelection  int
 
 	// Chat
 	viewport         viewport.Model
 	messages         map[string][]rawMessage
 	qntNotifications map[string]int
 	textarea         textarea.Model
+	// relativeTime shows message timestamps as "5m ago" instead of the
+	// wall clock time.
+	relativeTime bool
+	// typing holds, per conversation, when each user's typing notification
+	// expires. lastTyping is when we last told the server we were typing.
+	typing     map[string]map[string]time.Time
+	lastTyping time.Time
+	// readUpTo holds, per private chat, the ID of the last message a read
+	// receipt was sent for.
+	readUpTo map[string]string
+	// editing is the ID of our message whose text is in the textarea, or
+	// empty when writing a new one.
+	editing string
+	// thread is the ID of the message whose thread is open next to the
+	// viewport, in the conversation threadTab. Messages sent while it is
+	// open are replies to it.
+	thread    string
+	threadTab string
 
-	// Focus
+	// completions are the candidates of an ambiguous Tab completion of a
+	// slash command, shown until the next key press.
+	completions []string
+
+	// Focus. selected indexes the messages of the active conversation while
+	// picking one with FocusMessages.
 	focusedArea FocusState
+	selected    int
 	blinkOn     bool
 
 	// Shared
@@ -77,47 +249,55 @@ type model struct {
 	username    string
 	address     string
 	currentView ViewState
+	// theme colors the UI; plain is set when the terminal shows no colors.
+	theme       Theme
+	plain       bool
 	senderStyle lipgloss.Style
 	err         error
 	height      int
 	width       int
+
+	// Requests waiting for a reply, keyed by request ID, with the
+	// conversation their errors should be shown in.
+	lastRequestID int
+	pending       map[string]string
+
+	// Reconnection. seen holds the sequence numbers of every message
+	// received, lastSeq the highest of them, which is sent when resuming.
+	reconnecting bool
+	seen         map[uint64]bool
+	lastSeq      uint64
+
+	// capabilities negotiated with the server. helloPending is set until the
+	// server answers the hello sent on connect.
+	capabilities []message.Capability
+	helloPending bool
+	// serverCommands are the slash commands answered by bots on the server.
+	serverCommands []message.CommandInfo
 }
 
 type (
 	errMsg   error
 	blinkMsg struct{}
+	clockMsg struct{}
 )
 
 const sidebarWidth = 26
 
-func InitialModel(addr string) model {
+func InitialModel(serverURL string, tlsConfig *tls.Config, logger *slog.Logger) model {
 	ta := textarea.New()
-	ta.Placeholder = "Type your message... (/quit to exit)"
+	ta.Placeholder = "Type your message... (/help for commands, Ctrl+T: time format)"
 	ta.Focus()
 
 	ta.Prompt = "┃ "
-	ta.CharLimit = 200
+	ta.CharLimit = message.MaxMessageLength
 	ta.SetWidth(50)
 	ta.SetHeight(4)
 
-	ta.FocusedStyle.CursorLine = lipgloss.NewStyle().Background(lipgloss.Color("236"))
 	ta.ShowLineNumbers = false
-
 	ta.EndOfBufferCharacter = ' '
-	ta.FocusedStyle.EndOfBuffer = lipgloss.NewStyle().Background(lipgloss.Color("236"))
-	ta.BlurredStyle.EndOfBuffer = lipgloss.NewStyle().Background(lipgloss.Color("236"))
-
-	ta.FocusedStyle.Base = lipgloss.NewStyle().Background(lipgloss.Color("236"))
-	ta.BlurredStyle.Base = lipgloss.NewStyle().Background(lipgloss.Color("236"))
-	ta.FocusedStyle.Placeholder = lipgloss.NewStyle().Foreground(lipgloss.Color("240")).Background(lipgloss.Color("236"))
-	ta.BlurredStyle.Placeholder = lipgloss.NewStyle().Foreground(lipgloss.Color("240")).Background(lipgloss.Color("236"))
-	ta.FocusedStyle.Text = lipgloss.NewStyle().Background(lipgloss.Color("236"))
-	ta.BlurredStyle.Text = lipgloss.NewStyle().Background(lipgloss.Color("236"))
-	ta.FocusedStyle.Prompt = lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Background(lipgloss.Color("236"))
-	ta.BlurredStyle.Prompt = lipgloss.NewStyle().Foreground(lipgloss.Color("240")).Background(lipgloss.Color("236"))
 
 	vp := viewport.New(0, 0)
-	vp.Style = lipgloss.NewStyle().Background(lipgloss.Color("234"))
 
 	ta.KeyMap.InsertNewline.SetEnabled(false)
 
@@ -127,32 +307,214 @@ func InitialModel(addr string) model {
 	ui.CharLimit = 32
 	ui.Width = 20
 
-	bgColor := lipgloss.Color("234")
-	emptyStyle := lipgloss.NewStyle().Background(bgColor)
-
-	ui.PromptStyle = emptyStyle
-	ui.TextStyle = emptyStyle
-	ui.PlaceholderStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("240")).Background(bgColor)
-	ui.Cursor.Style = emptyStyle
-	ui.Cursor.TextStyle = emptyStyle
-
 	ui.Prompt = ""
 
-	return model{
+	pi := textinput.New()
+	pi.Placeholder = "Password"
+	pi.EchoMode = textinput.EchoPassword
+	pi.EchoCharacter = '•'
+	pi.Width = 20
+	pi.Prompt = ""
+
+	m := model{
 		viewport:         vp,
 		textarea:         ta,
 		messages:         make(map[string][]rawMessage),
 		err:              nil,
-		senderStyle:      lipgloss.NewStyle().Foreground(lipgloss.Color("205")).Background(lipgloss.Color("234")).Bold(true),
-		chatClient:       CreateChatClient(log.Printf),
-		address:          addr,
+		chatClient:       CreateChatClient(logger, tlsConfig),
+		address:          serverURL,
 		usernameInput:    ui,
+		passwordInput:    pi,
 		currentView:      ViewLogin,
 		loginHelper:      "",
-		currentUsers:     []string{"ALL"},
+		channels:         []string{message.LobbyChannel},
+		currentUsers:     []string{},
 		currentSelection: 0,
 		qntNotifications: make(map[string]int),
+		seen:             make(map[uint64]bool),
+		typing:           make(map[string]map[string]time.Time),
+		readUpTo:         make(map[string]string),
+		pending:          make(map[string]string),
+	}
+	m.applyTheme(Themes["dark"])
+	return m
+}
+
+// WithProfile makes the model log in with the profile called name of cfg as
+// soon as it is connected, and store the session token of every login in it.
+func (m model) WithProfile(cfg *Config, name string) model {
+	profile, _ := cfg.Profile(name)
+	m.config = cfg
+	m.profile = name
+	if profile.Username == "" {
+		return m
+	}
+
+	m.usernameInput.SetValue(profile.Username)
+	if profile.Token != "" || profile.Password != "" {
+		m.autoLogin = &profile
+		m.loginHelper = "Connecting as " + profile.Username + "…"
+		return m
+	}
+	m.loginField = LoginFieldPassword
+	m.usernameInput.Blur()
+	m.passwordInput.Focus()
+	return m
+}
+
+// nextAutoLogin tries the next saved credential of the profile, the token
+// before the password, or returns nil once there is none left.
+func (m *model) nextAutoLogin() tea.Cmd {
+	p := m.autoLogin
+	if p == nil || m.conn == nil {
+		return nil
+	}
+
+	m.username = p.Username
+	m.loginHelper = "Logging in as " + p.Username + "…"
+	switch {
+	case p.Token != "":
+		token := p.Token
+		p.Token = ""
+		return resumeCmd(m.chatClient, m.conn, p.Username, token, 0)
+	case p.Password != "":
+		password := p.Password
+		p.Password = ""
+		return loginCmd(m.chatClient, m.conn, p.Username, password, false)
 	}
+	m.autoLogin = nil
+	m.loginHelper = ""
+	return nil
+}
+
+// rememberSession stores the session token in the profile the client was
+// started with, unless it was for another user.
+func (m model) rememberSession() tea.Cmd {
+	if m.config == nil || m.token == "" {
+		return nil
+	}
+	if p, ok := m.config.Profile(m.profile); !ok || (p.Username != "" && p.Username != m.username) {
+		return nil
+	}
+	return saveTokenCmd(m.config, m.profile, m.username, m.token)
+}
+
+// supports reports whether the server negotiated the given capability.
+func (m model) supports(c message.Capability) bool {
+	return slices.Contains(m.capabilities, c)
+}
+
+// tabs returns every conversation shown in the sidebar, channels first.
+func (m model) tabs() []string {
+	tabs := make([]string, 0, len(m.channels)+len(m.currentUsers))
+	tabs = append(tabs, m.channels...)
+	return append(tabs, m.currentUsers...)
+}
+
+// activeTab returns the key of the messages map for the selected conversation.
+func (m model) activeTab() string {
+	tabs := m.tabs()
+	if m.currentSelection < 0 || m.currentSelection >= len(tabs) {
+		return message.LobbyChannel
+	}
+	return tabs[m.currentSelection]
+}
+
+// selectTab moves the selection to the named conversation, falling back to
+// the first one when it is no longer in the sidebar.
+func (m *model) selectTab(name string) {
+	m.currentSelection = 0
+	for i, tab := range m.tabs() {
+		if tab == name {
+			m.currentSelection = i
+			break
+		}
+	}
+	if m.thread != "" && m.threadTab != m.activeTab() {
+		m.closeThread()
+	}
+	m.viewport.SetContent(m.renderMessages(m.activeTab()))
+	m.viewport.GotoBottom()
+}
+
+// threadWidth is the width of the thread pane, taken from the chat area.
+func (m model) threadWidth() int {
+	return (m.width - sidebarWidth) / 2
+}
+
+// resizeChat lays out the chat area for the window size, sharing it with the
+// thread pane while one is open.
+func (m *model) resizeChat() {
+	taWidth := m.width - sidebarWidth - 2
+	m.textarea.SetWidth(taWidth)
+	m.viewport.Width = taWidth
+	if m.thread != "" {
+		m.viewport.Width -= m.threadWidth()
+	}
+	taHeight := m.textarea.Height() + 2
+	m.viewport.Height = m.height - taHeight - statusLineHeight
+}
+
+// openThread shows the thread started by the message id of tab next to the
+// viewport and asks the server for its replies.
+func (m *model) openThread(tab string, id string) tea.Cmd {
+	m.thread = id
+	m.threadTab = tab
+	m.resizeChat()
+	m.viewport.SetContent(m.renderMessages(tab))
+	m.viewport.GotoBottom()
+
+	if m.conn == nil || m.reconnecting {
+		return nil
+	}
+	return threadCmd(m.chatClient, m.conn, id, m.newRequest(tab))
+}
+
+// logout forgets the current session, its messages included, and goes back
+// to the login view. The connection must be closed by the caller.
+func (m *model) logout() {
+	m.conn = nil
+	m.token = ""
+	m.currentView = ViewLogin
+	m.reconnecting = false
+	m.capabilities = nil
+	m.serverCommands = nil
+	m.focusedArea = FocusChat
+	m.editing = ""
+	m.thread = ""
+	m.threadTab = ""
+	m.channels = []string{message.LobbyChannel}
+	m.availableChannels = nil
+	m.pendingChannel = ""
+	m.currentUsers = []string{}
+	m.currentSelection = 0
+	m.messages = make(map[string][]rawMessage)
+	m.qntNotifications = make(map[string]int)
+	m.seen = make(map[uint64]bool)
+	m.lastSeq = 0
+	m.typing = make(map[string]map[string]time.Time)
+	m.readUpTo = make(map[string]string)
+	m.pending = make(map[string]string)
+	m.textarea.Reset()
+	m.resizeChat()
+	m.viewport.SetContent("")
+}
+
+// signedOut cleans up after the server ended our session, as logout does,
+// and shows the login view with reason. The session is not resumed.
+func (m *model) signedOut(reason string) tea.Cmd {
+	m.logout()
+	m.autoLogin = nil
+	m.loginHelper = reason
+	return connectCmd(m.chatClient, m.address)
+}
+
+func (m *model) closeThread() {
+	m.thread = ""
+	m.threadTab = ""
+	m.resizeChat()
+	m.viewport.SetContent(m.renderMessages(m.activeTab()))
+	m.viewport.GotoBottom()
 }
 
 func (m model) Init() tea.Cmd {
@@ -160,5 +522,6 @@ func (m model) Init() tea.Cmd {
 		textarea.Blink,
 		connectCmd(m.chatClient, m.address),
 		blinkCmd(),
+		clockCmd(),
 	)
 }
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+// Theme names the colors of every part of the UI. Colors are ANSI codes
+// ("0" to "255") or hex ("#1e1e2e"); lipgloss brings them down to what the
+// terminal supports, and drops them altogether when NO_COLOR is set.
+type Theme struct {
+	// Background is behind the chat, the login screen and the status line.
+	Background lipgloss.Color `json:"background"`
+	// Sidebar is behind the list of conversations.
+	Sidebar lipgloss.Color `json:"sidebar"`
+	// Panel is behind the message input and the sidebar title.
+	Panel lipgloss.Color `json:"panel"`
+	// Text is the text of messages.
+	Text lipgloss.Color `json:"text"`
+	// Subtle is for timestamps, placeholders, hints and borders.
+	Subtle lipgloss.Color `json:"subtle"`
+	// Dim is for server and system messages, receipts and typing.
+	Dim lipgloss.Color `json:"dim"`
+	// Heading is for the section titles of the sidebar.
+	Heading lipgloss.Color `json:"heading"`
+	// Item is for sidebar entries and what is typed on the login screen.
+	Item lipgloss.Color `json:"item"`
+	// Accent is for titles, prompts, our reactions and thread markers.
+	Accent lipgloss.Color `json:"accent"`
+	// Sender is for the names of the authors of messages.
+	Sender lipgloss.Color `json:"sender"`
+	// Unread is for unread message counts in the sidebar.
+	Unread lipgloss.Color `json:"unread"`
+	// Warning is for login failures and connection problems.
+	Warning lipgloss.Color `json:"warning"`
+	// Selection and SelectionText are the background and text of the
+	// selected conversation.
+	Selection     lipgloss.Color `json:"selection"`
+	SelectionText lipgloss.Color `json:"selection_text"`
+}
+
+// Themes are the built-in themes by name; dark is the default.
+var Themes = map[string]Theme{
+	"dark": {
+		Background:    "234",
+		Sidebar:       "235",
+		Panel:         "236",
+		Text:          "252",
+		Subtle:        "240",
+		Dim:           "244",
+		Heading:       "245",
+		Item:          "250",
+		Accent:        "86",
+		Sender:        "205",
+		Unread:        "208",
+		Warning:       "208",
+		Selection:     "62",
+		SelectionText: "0",
+	},
+	"light": {
+		Background:    "255",
+		Sidebar:       "254",
+		Panel:         "253",
+		Text:          "235",
+		Subtle:        "245",
+		Dim:           "242",
+		Heading:       "240",
+		Item:          "237",
+		Accent:        "30",
+		Sender:        "162",
+		Unread:        "166",
+		Warning:       "160",
+		Selection:     "25",
+		SelectionText: "255",
+	},
+	// high-contrast keeps to the 16 basic colors, which every terminal has
+	// and users often tune for legibility.
+	"high-contrast": {
+		Background:    "0",
+		Sidebar:       "0",
+		Panel:         "0",
+		Text:          "15",
+		Subtle:        "7",
+		Dim:           "7",
+		Heading:       "15",
+		Item:          "15",
+		Accent:        "14",
+		Sender:        "11",
+		Unread:        "9",
+		Warning:       "11",
+		Selection:     "15",
+		SelectionText: "0",
+	},
+}
+
+// ThemeNames returns the names of the built-in themes, sorted.
+func ThemeNames() []string {
+	names := make([]string, 0, len(Themes))
+	for name := range Themes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// LoadTheme returns the built-in theme called name, or else reads a theme
+// from the JSON file at that path. The colors a file leaves out come from
+// the theme named by its "base" key, dark by default.
+func LoadTheme(name string) (Theme, error) {
+	if theme, ok := Themes[name]; ok {
+		return theme, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return Theme{}, fmt.Errorf("unknown theme %q: not one of %s, nor a readable file: %w", name, strings.Join(ThemeNames(), ", "), err)
+	}
+
+	var base struct {
+		Base string `json:"base"`
+	}
+	if err := json.Unmarshal(data, &base); err != nil {
+		return Theme{}, fmt.Errorf("reading theme from %s: %w", name, err)
+	}
+	if base.Base == "" {
+		base.Base = "dark"
+	}
+	theme, ok := Themes[base.Base]
+	if !ok {
+		return Theme{}, fmt.Errorf("%s: unknown base theme %q", name, base.Base)
+	}
+	if err := json.Unmarshal(data, &theme); err != nil {
+		return Theme{}, fmt.Errorf("reading theme from %s: %w", name, err)
+	}
+	if err := theme.validate(); err != nil {
+		return Theme{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return theme, nil
+}
+
+func (t Theme) validate() error {
+	for _, c := range []lipgloss.Color{
+		t.Background, t.Sidebar, t.Panel, t.Text, t.Subtle, t.Dim, t.Heading,
+		t.Item, t.Accent, t.Sender, t.Unread, t.Warning, t.Selection, t.SelectionText,
+	} {
+		if !validColor(string(c)) {
+			return fmt.Errorf("invalid color %q: use an ANSI code from 0 to 255 or #rrggbb", c)
+		}
+	}
+	return nil
+}
+
+func validColor(c string) bool {
+	if hex, ok := strings.CutPrefix(c, "#"); ok {
+		_, err := strconv.ParseUint(hex, 16, 32)
+		return err == nil && len(hex) == 6
+	}
+	n, err := strconv.Atoi(c)
+	return err == nil && n >= 0 && n <= 255
+}
+
+// plain reports whether the terminal shows no colors or text attributes,
+// because it cannot or NO_COLOR is set. The UI then marks with characters
+// what it would otherwise only highlight.
+func plain() bool {
+	return lipgloss.ColorProfile() == termenv.Ascii
+}
+
+// backgroundSequence returns the escape sequence setting the background to
+// c in the terminal's color profile, or nothing without colors.
+func backgroundSequence(c lipgloss.Color) string {
+	seq := lipgloss.ColorProfile().Color(string(c)).Sequence(true)
+	if seq == "" {
+		return ""
+	}
+	return termenv.CSI + seq + "m"
+}
+
+// WithTheme makes the model draw itself with theme.
+func (m model) WithTheme(theme Theme) model {
+	m.applyTheme(theme)
+	return m
+}
+
+// applyTheme styles the components the model keeps, which draw themselves,
+// with theme; the rest is styled with m.theme as it is drawn.
+func (m *model) applyTheme(theme Theme) {
+	m.theme = theme
+	m.plain = plain()
+	bg := lipgloss.NewStyle().Background(theme.Panel)
+
+	ta := &m.textarea
+	ta.FocusedStyle.CursorLine = bg
+	ta.FocusedStyle.EndOfBuffer = bg
+	ta.BlurredStyle.EndOfBuffer = bg
+	ta.FocusedStyle.Base = bg
+	ta.BlurredStyle.Base = bg
+	ta.FocusedStyle.Placeholder = bg.Foreground(theme.Subtle)
+	ta.BlurredStyle.Placeholder = bg.Foreground(theme.Subtle)
+	ta.FocusedStyle.Text = bg.Foreground(theme.Text)
+	ta.BlurredStyle.Text = bg.Foreground(theme.Text)
+	ta.FocusedStyle.Prompt = bg.Foreground(theme.Accent)
+	ta.BlurredStyle.Prompt = bg.Foreground(theme.Subtle)
+
+	m.viewport.Style = lipgloss.NewStyle().Background(theme.Background)
+
+	empty := lipgloss.NewStyle().Background(theme.Background)
+	for _, input := range []*textinput.Model{&m.usernameInput, &m.passwordInput} {
+		input.PromptStyle = empty
+		input.TextStyle = empty.Foreground(theme.Item)
+		input.PlaceholderStyle = empty.Foreground(theme.Subtle)
+		input.Cursor.Style = empty
+		input.Cursor.TextStyle = empty
+	}
+
+	m.senderStyle = lipgloss.NewStyle().Foreground(theme.Sender).Background(theme.Background).Bold(true)
+}
@@ -1,31 +1,93 @@
 package client
 
 import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	message "chatui/internal/protocol"
+
 	"github.com/charmbracelet/bubbles/textarea"
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/coder/websocket"
 )
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case connectedMsg:
 		m.conn = msg.conn
+		m.helloPending = true
+		return m, listenCmd(m.chatClient, m.conn)
+	case helloMsg:
+		m.helloPending = false
+		m.capabilities = msg.capabilities
+		m.serverCommands = msg.commands
+		m.textarea.CharLimit = message.MaxMessageLength
+		if msg.maxLength > 0 {
+			m.textarea.CharLimit = msg.maxLength
+		}
+		login := m.nextAutoLogin()
+		return m, tea.Batch(listenCmd(m.chatClient, m.conn), login)
 	case errorMsg:
 		m.err = msg.err
+	case disconnectedMsg:
+		if msg.conn != m.conn {
+			// A listener on a connection that was already replaced.
+			return m, nil
+		}
+		m.conn = nil
+		if websocket.CloseStatus(msg.err) == message.CloseSessionReplaced {
+			return m, m.signedOut("Logged in from another session")
+		}
+		var closeErr websocket.CloseError
+		if errors.As(msg.err, &closeErr) && (closeErr.Code == websocket.StatusPolicyViolation || closeErr.Code == message.CloseModerated) {
+			// Reconnecting right away would only get us disconnected again.
+			return m, m.signedOut("Disconnected by the server: " + closeErr.Reason)
+		}
+		m.reconnecting = true
+		return m, reconnectCmd(m.chatClient, m.address, 0)
+	case connectAttemptMsg:
+		if msg.conn == nil {
+			m.reconnecting = true
+			return m, reconnectCmd(m.chatClient, m.address, msg.attempt+1)
+		}
+		m.conn = msg.conn
+		m.helloPending = true
+		if m.currentView == ViewChat {
+			return m, tea.Batch(
+				resumeCmd(m.chatClient, m.conn, m.username, m.token, m.lastSeq),
+				listenCmd(m.chatClient, m.conn),
+			)
+		}
+		m.reconnecting = false
+		return m, listenCmd(m.chatClient, m.conn)
+	case loginMsg:
+		if m.helloPending && !msg.success {
+			// Servers that predate the handshake reject the hello as a bad
+			// login; carry on without any optional features.
+			m.helloPending = false
+			m.capabilities = nil
+			login := m.nextAutoLogin()
+			return m, tea.Batch(listenCmd(m.chatClient, m.conn), login)
+		}
+		m.helloPending = false
 	case blinkMsg:
 		m.blinkOn = !m.blinkOn
 		return m, blinkCmd()
+	case clockMsg:
+		if m.relativeTime && m.currentView == ViewChat {
+			m.viewport.SetContent(m.renderMessages(m.activeTab()))
+		}
+		return m, clockCmd()
 
 	case tea.WindowSizeMsg:
-		chatAreaWidth := msg.Width - sidebarWidth
-		taWidth := chatAreaWidth - 2
-		m.viewport.Width = taWidth
-		m.textarea.SetWidth(taWidth)
-		taHeight := m.textarea.Height() + 2
-		m.viewport.Height = msg.Height - taHeight
-
-		m.viewport.GotoBottom()
 		m.height = msg.Height
 		m.width = msg.Width
+		m.resizeChat()
+		m.viewport.GotoBottom()
 	}
 	switch m.currentView {
 	case ViewLogin:
@@ -38,16 +100,37 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 func (m model) updateLogin(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var uiCmd tea.Cmd
-	m.usernameInput, uiCmd = m.usernameInput.Update(msg)
+	if m.loginField == LoginFieldPassword {
+		m.passwordInput, uiCmd = m.passwordInput.Update(msg)
+	} else {
+		m.usernameInput, uiCmd = m.usernameInput.Update(msg)
+	}
 
 	switch msg := msg.(type) {
 	case loginMsg:
 		if msg.success {
 			m.currentView = ViewChat
-			return m, listenCmd(m.chatClient, m.conn)
+			m.token = msg.token
+			if msg.username != "" {
+				m.username = msg.username
+			}
+			m.passwordInput.Reset()
+			m.autoLogin = nil
+			return m, tea.Batch(listenCmd(m.chatClient, m.conn), m.rememberSession())
+		}
+		if m.autoLogin != nil {
+			if login := m.nextAutoLogin(); login != nil {
+				return m, tea.Batch(listenCmd(m.chatClient, m.conn), login)
+			}
+			// The saved credentials are no good; ask for the password.
+			m.loginField = LoginFieldPassword
+			m.usernameInput.Blur()
+			focus := m.passwordInput.Focus()
+			m.loginHelper = "Login failed: " + msg.message
+			return m, tea.Batch(listenCmd(m.chatClient, m.conn), focus)
 		}
 		m.loginHelper = "Login failed: " + msg.message
-		return m, nil
+		return m, listenCmd(m.chatClient, m.conn)
 	case tea.KeyMsg:
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
@@ -55,14 +138,33 @@ func (m model) updateLogin(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.chatClient.Disconnect(m.conn)
 			}
 			return m, tea.Quit
-		case tea.KeyEnter:
+		case tea.KeyTab, tea.KeyShiftTab, tea.KeyUp, tea.KeyDown:
+			if m.loginField == LoginFieldUsername {
+				m.loginField = LoginFieldPassword
+				m.usernameInput.Blur()
+				return m, m.passwordInput.Focus()
+			}
+			m.loginField = LoginFieldUsername
+			m.passwordInput.Blur()
+			return m, m.usernameInput.Focus()
+		case tea.KeyEnter, tea.KeyCtrlR:
+			if m.conn == nil {
+				m.loginHelper = "Not connected to the server, retrying…"
+				return m, nil
+			}
+
 			username := m.usernameInput.Value()
+			password := m.passwordInput.Value()
+
+			if m.loginField == LoginFieldUsername && password == "" && msg.Type == tea.KeyEnter {
+				m.loginField = LoginFieldPassword
+				m.usernameInput.Blur()
+				return m, m.passwordInput.Focus()
+			}
+
 			m.username = username
 
-			return m, tea.Batch(
-				setUsernameCmd(m.chatClient, m.conn, username),
-				listenCmd(m.chatClient, m.conn),
-			)
+			return m, loginCmd(m.chatClient, m.conn, username, password, msg.Type == tea.KeyCtrlR)
 		default:
 			m.loginHelper = ""
 			return m, uiCmd
@@ -80,6 +182,7 @@ func (m model) updateChat(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 	case userListMsg:
+		active := m.activeTab()
 		filteredUsers := []string{}
 		for _, user := range msg.users {
 			if user != m.username {
@@ -87,36 +190,233 @@ func (m model) updateChat(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 
-		m.currentUsers = append([]string{"ALL"}, filteredUsers...)
+		m.currentUsers = filteredUsers
+		m.selectTab(active)
 		return m, listenCmd(m.chatClient, m.conn)
-	case receivedMsg:
+	case channelListMsg:
+		active := m.activeTab()
+		m.channels = msg.joined
+		m.availableChannels = msg.available
 
-		formattedMsg := rawMessage{username: msg.username, content: msg.content}
+		if m.pendingChannel != "" && slices.Contains(m.channels, m.pendingChannel) {
+			active = m.pendingChannel
+			m.pendingChannel = ""
+		}
+		m.selectTab(active)
+		return m, listenCmd(m.chatClient, m.conn)
+	case noticeMsg:
+		tab, ok := m.pending[msg.requestID]
+		delete(m.pending, msg.requestID)
+		if !ok {
+			tab = m.activeTab()
+		}
+		m.addSystemMessageTo(tab, msg.text)
+		return m, listenCmd(m.chatClient, m.conn)
+	case serverErrorMsg:
+		tab, ok := m.pending[msg.requestID]
+		delete(m.pending, msg.requestID)
+		if !ok {
+			tab = m.activeTab()
+		}
+		m.addSystemMessageTo(tab, "Error: "+msg.message)
+		return m, listenCmd(m.chatClient, m.conn)
+	case channelResponseMsg:
+		delete(m.pending, msg.requestID)
+		if !msg.success {
+			if msg.channel == m.pendingChannel {
+				m.pendingChannel = ""
+			}
+			m.addSystemMessage(msg.channel + ": " + msg.message)
+		}
+		return m, listenCmd(m.chatClient, m.conn)
+	case loginMsg:
+		// Only sent while in the chat view when resuming after a reconnect.
+		if !msg.success {
+			m.currentView = ViewLogin
+			m.reconnecting = false
+			m.loginHelper = "Session lost: " + msg.message
+			return m, listenCmd(m.chatClient, m.conn)
+		}
+		m.reconnecting = false
+		m.token = msg.token
+		m.addSystemMessage("Reconnected")
+		return m, tea.Batch(listenCmd(m.chatClient, m.conn), m.rememberSession())
+	case typingMsg:
+		tab := m.chatTabFor(receivedMsg{username: msg.username, destination: msg.destination})
+		if m.typing[tab] == nil {
+			m.typing[tab] = make(map[string]time.Time)
+		}
+		m.typing[tab][msg.username] = time.Now().Add(message.TypingTimeout)
+		return m, tea.Batch(listenCmd(m.chatClient, m.conn), typingExpiryCmd())
+	case typingExpiredMsg:
+		now := time.Now()
+		for tab, users := range m.typing {
+			for user, expires := range users {
+				if now.After(expires) {
+					delete(users, user)
+				}
+			}
+			if len(users) == 0 {
+				delete(m.typing, tab)
+			}
+		}
+		return m, nil
+	case historyMsg:
+		// Threads started in this batch already count their replies.
+		batch := make(map[string]bool)
+		for _, received := range msg.messages {
+			batch[received.id] = true
+		}
+		for _, received := range msg.messages {
+			if !m.markSeen(received.seq) {
+				continue
+			}
+			chatTab := m.chatTabFor(received)
+			m.messages[chatTab] = append(m.messages[chatTab], newRawMessage(received))
+			if received.parentID != "" && !batch[received.parentID] {
+				m.countReply(chatTab, received)
+			}
+		}
 
-		var chatTab string
-		if msg.destination == "ALL" {
-			chatTab = "ALL"
-		} else if msg.username == m.username {
-			chatTab = msg.destination
-		} else {
-			chatTab = msg.username
+		m.viewport.SetContent(m.renderMessages(m.activeTab()))
+		m.viewport.GotoBottom()
+		return m, listenCmd(m.chatClient, m.conn)
+	case receivedMsg:
+		delete(m.pending, msg.requestID)
+		if !m.markSeen(msg.seq) {
+			return m, listenCmd(m.chatClient, m.conn)
 		}
 
+		formattedMsg := newRawMessage(msg)
+
+		chatTab := m.chatTabFor(msg)
+
 		m.messages[chatTab] = append(m.messages[chatTab], formattedMsg)
+		delete(m.typing[chatTab], msg.username)
+		if msg.parentID != "" {
+			m.countReply(chatTab, msg)
+		}
 
-		activeUser := m.currentUsers[m.currentSelection]
+		var readCmd tea.Cmd
+		activeUser := m.activeTab()
 		if chatTab == activeUser {
 			m.viewport.SetContent(m.renderMessages(activeUser))
 			m.viewport.GotoBottom()
+			if m.focusedArea == FocusChat {
+				readCmd = m.markRead(chatTab)
+			}
 		} else {
 			m.qntNotifications[chatTab]++
 		}
 		m.viewport.GotoBottom()
+		return m, tea.Batch(listenCmd(m.chatClient, m.conn), readCmd)
+	case messageChangeMsg:
+		delete(m.pending, msg.requestID)
+		tab := m.chatTabFor(receivedMsg{username: msg.username, destination: msg.destination})
+		msgs := m.messages[tab]
+		for i := range msgs {
+			if msgs[i].id != msg.id {
+				continue
+			}
+			if msg.deleted {
+				msgs[i].content = ""
+				msgs[i].deleted = true
+			} else {
+				msgs[i].content = msg.content
+				msgs[i].edited = true
+			}
+			break
+		}
+		if msg.deleted && msg.id == m.editing {
+			m.stopEditing()
+		}
+		if tab == m.activeTab() {
+			m.viewport.SetContent(m.renderMessages(tab))
+		}
+		return m, listenCmd(m.chatClient, m.conn)
+	case threadMsg:
+		delete(m.pending, msg.requestID)
+		tab := m.chatTabFor(msg.parent)
+		for _, received := range append([]receivedMsg{msg.parent}, msg.replies...) {
+			i := slices.IndexFunc(m.messages[tab], func(raw rawMessage) bool { return raw.id == received.id })
+			if i < 0 {
+				m.markSeen(received.seq)
+				m.messages[tab] = insertBySeq(m.messages[tab], newRawMessage(received))
+				continue
+			}
+			raw := &m.messages[tab][i]
+			raw.content, raw.edited, raw.deleted = received.content, received.edited, received.deleted
+			raw.reactions, raw.replies, raw.members = received.reactions, received.replies, received.members
+		}
+		if tab == m.activeTab() {
+			m.viewport.SetContent(m.renderMessages(tab))
+		}
+		return m, listenCmd(m.chatClient, m.conn)
+	case reactionMsg:
+		delete(m.pending, msg.requestID)
+		tab := m.chatTabFor(receivedMsg{username: msg.author, destination: msg.destination})
+		msgs := m.messages[tab]
+		for i := range msgs {
+			if msgs[i].id == msg.messageID {
+				msgs[i].reactions = msg.reactions
+				break
+			}
+		}
+		if tab == m.activeTab() {
+			m.viewport.SetContent(m.renderMessages(tab))
+		}
+		return m, listenCmd(m.chatClient, m.conn)
+	case receiptMsg:
+		msgs := m.messages[msg.reader]
+		for i := len(msgs) - 1; i >= 0; i-- {
+			if msgs[i].id != msg.messageID {
+				continue
+			}
+			if msg.status == message.ReceiptRead {
+				// A read receipt covers everything sent before it too.
+				for j := i; j >= 0 && msgs[j].status != message.ReceiptRead; j-- {
+					if msgs[j].username == m.username {
+						msgs[j].status = message.ReceiptRead
+					}
+				}
+			} else if msgs[i].status != message.ReceiptRead {
+				msgs[i].status = msg.status
+			}
+			break
+		}
+		if msg.reader == m.activeTab() {
+			m.viewport.SetContent(m.renderMessages(msg.reader))
+		}
 		return m, listenCmd(m.chatClient, m.conn)
 
 	case tea.KeyMsg:
+		m.completions = nil
+		if m.focusedArea == FocusMessages && msg.Type != tea.KeyCtrlC {
+			return m.updateSelection(msg)
+		}
+
 		switch msg.Type {
-		case tea.KeyCtrlC, tea.KeyEsc:
+		case tea.KeyCtrlC:
+			return m, tea.Quit
+		case tea.KeyCtrlR:
+			if m.focusedArea == FocusChat && m.editing == "" && m.supports(message.CapReactions) {
+				if last := m.nextSelectable(len(m.messages[m.activeTab()]), -1); last >= 0 {
+					m.focusedArea = FocusMessages
+					m.selected = last
+					m.textarea.Blur()
+					m.showSelected()
+				}
+			}
+			return m, nil
+		case tea.KeyEsc:
+			if m.editing != "" {
+				m.stopEditing()
+				return m, nil
+			}
+			if m.thread != "" {
+				m.closeThread()
+				return m, nil
+			}
 			return m, tea.Quit
 		case tea.KeyEnter:
 
@@ -125,51 +425,69 @@ func (m model) updateChat(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 
 			value := m.textarea.Value()
+			isCommand := m.editing == "" && strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//")
+			if !isCommand && (m.conn == nil || m.reconnecting) {
+				return m, nil
+			}
+
 			m.textarea.Reset()
+			m.lastTyping = time.Time{}
 			m.viewport.GotoBottom()
 
-			if value == "/quit" {
-				if m.conn != nil {
-					m.chatClient.Disconnect(m.conn)
+			if m.editing != "" {
+				id := m.editing
+				m.editing = ""
+				requestID := m.newRequest(m.activeTab())
+				if strings.TrimSpace(value) == "" {
+					return m, deleteCmd(m.chatClient, m.conn, id, requestID)
 				}
-				return m, tea.Quit
+				return m, editCmd(m.chatClient, m.conn, id, value, requestID)
 			}
 
-			destination := "ALL"
-
-			if m.currentSelection > 0 && m.currentSelection < len(m.currentUsers) {
-				destination = m.currentUsers[m.currentSelection]
+			if isCommand {
+				return m, m.runCommand(value)
 			}
+			// A doubled slash sends a message starting with one.
+			value = strings.TrimPrefix(value, "/")
 
-			return m, sendCmd(m.chatClient, m.conn, value, destination)
+			requestID := m.newRequest(m.activeTab())
+			return m, sendCmd(m.chatClient, m.conn, value, m.activeTab(), m.thread, requestID)
+		case tea.KeyCtrlT:
+			m.relativeTime = !m.relativeTime
+			m.viewport.SetContent(m.renderMessages(m.activeTab()))
+			return m, nil
 		case tea.KeyTab:
+			if m.focusedArea == FocusChat && m.editing == "" && strings.HasPrefix(m.textarea.Value(), "/") {
+				var value string
+				value, m.completions = m.completeCommand(m.textarea.Value())
+				m.textarea.SetValue(value)
+				return m, nil
+			}
 			if m.focusedArea == FocusChat {
 				m.focusedArea = FocusUserList
+				if m.editing != "" {
+					m.stopEditing()
+				}
 				m.textarea.Blur()
 				return m, nil
 			}
 			m.focusedArea = FocusChat
 			cmd := tea.Batch(m.textarea.Focus(), textarea.Blink)
-			activeUser := m.currentUsers[m.currentSelection]
-			m.qntNotifications[activeUser] = 0
-			return m, cmd
+			m.qntNotifications[m.activeTab()] = 0
+			return m, tea.Batch(cmd, m.markRead(m.activeTab()))
 		case tea.KeyUp:
+			if m.focusedArea == FocusChat && m.editing == "" && m.textarea.Value() == "" && m.editLastMessage() {
+				return m, nil
+			}
 			if m.focusedArea == FocusUserList {
 				if m.currentSelection > 0 {
-					m.currentSelection--
-					activeUser := m.currentUsers[m.currentSelection]
-					m.viewport.SetContent(m.renderMessages(activeUser))
-					m.viewport.GotoBottom()
+					m.selectTab(m.tabs()[m.currentSelection-1])
 				}
 			}
 		case tea.KeyDown:
 			if m.focusedArea == FocusUserList {
-				if m.currentSelection < len(m.currentUsers)-1 {
-					m.currentSelection++
-
-					activeUser := m.currentUsers[m.currentSelection]
-					m.viewport.SetContent(m.renderMessages(activeUser))
-					m.viewport.GotoBottom()
+				if m.currentSelection < len(m.tabs())-1 {
+					m.selectTab(m.tabs()[m.currentSelection+1])
 				}
 			}
 
@@ -180,9 +498,245 @@ func (m model) updateChat(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 	}
 
+	var typCmd tea.Cmd
 	if m.focusedArea == FocusChat {
+		before := m.textarea.Value()
 		m.textarea, tiCmd = m.textarea.Update(msg)
+		typCmd = m.notifyTyping(before)
+	}
+
+	return m, tea.Batch(tiCmd, vpCmd, typCmd)
+}
+
+// markRead sends a read receipt for the newest message received in a private
+// chat, unless one was already sent for it.
+func (m *model) markRead(tab string) tea.Cmd {
+	if message.IsChannel(tab) || m.conn == nil || m.reconnecting || !m.supports(message.CapReceipts) {
+		return nil
+	}
+
+	msgs := m.messages[tab]
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].system || msgs[i].username == m.username || msgs[i].id == "" {
+			continue
+		}
+		if m.readUpTo[tab] == msgs[i].id {
+			return nil
+		}
+		m.readUpTo[tab] = msgs[i].id
+		return readReceiptCmd(m.chatClient, m.conn, msgs[i].username, msgs[i].id)
+	}
+	return nil
+}
+
+// updateSelection handles keys while picking a message to react to: Up and
+// Down move between messages, the number keys toggle one of reactionEmojis,
+// and Esc, Tab or Ctrl+R go back to writing.
+func (m model) updateSelection(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	tab := m.activeTab()
+
+	switch msg.Type {
+	case tea.KeyEsc, tea.KeyCtrlR, tea.KeyTab:
+		m.focusedArea = FocusChat
+		m.viewport.SetContent(m.renderMessages(tab))
+		m.viewport.GotoBottom()
+		return m, tea.Batch(m.textarea.Focus(), textarea.Blink)
+	case tea.KeyEnter:
+		if m.selected >= len(m.messages[tab]) {
+			return m, nil
+		}
+		id := m.messages[tab][m.selected].id
+		m.focusedArea = FocusChat
+		return m, tea.Batch(m.openThread(tab, id), m.textarea.Focus(), textarea.Blink)
+	case tea.KeyUp, tea.KeyDown:
+		step := 1
+		if msg.Type == tea.KeyUp {
+			step = -1
+		}
+		if next := m.nextSelectable(m.selected, step); next >= 0 {
+			m.selected = next
+			m.showSelected()
+		}
+		return m, nil
+	case tea.KeyRunes:
+		if len(msg.Runes) != 1 || msg.Runes[0] < '1' || int(msg.Runes[0]-'1') >= len(reactionEmojis) {
+			return m, nil
+		}
+		if m.conn == nil || m.reconnecting || m.selected >= len(m.messages[tab]) {
+			return m, nil
+		}
+
+		raw := m.messages[tab][m.selected]
+		emoji := reactionEmojis[msg.Runes[0]-'1']
+		remove := slices.Contains(raw.reactions[emoji], m.username)
+		requestID := m.newRequest(tab)
+		return m, reactionCmd(m.chatClient, m.conn, raw.id, emoji, remove, requestID)
+	}
+	return m, nil
+}
+
+// nextSelectable returns the index of the first message that can be reacted
+// to in the active conversation, starting after from and moving by step. It
+// returns -1 if there is none.
+func (m model) nextSelectable(from int, step int) int {
+	msgs := m.messages[m.activeTab()]
+	for i := from + step; i >= 0 && i < len(msgs); i += step {
+		if !msgs[i].system && !msgs[i].deleted && msgs[i].id != "" && msgs[i].parentID == "" {
+			return i
+		}
 	}
+	return -1
+}
+
+// showSelected redraws the messages and scrolls the selected one into view.
+func (m *model) showSelected() {
+	blocks := m.renderMessageBlocks(m.activeTab())
+	m.viewport.SetContent(m.renderMessages(m.activeTab()))
+
+	top := 0
+	for _, block := range blocks[:min(m.selected, len(blocks))] {
+		if block != "" {
+			top += lipgloss.Height(block)
+		}
+	}
+	if top < m.viewport.YOffset || top >= m.viewport.YOffset+m.viewport.Height {
+		m.viewport.SetYOffset(top - m.viewport.Height/2)
+	}
+}
 
-	return m, tea.Batch(tiCmd, vpCmd)
+// countReply adds reply to the reply count and members of the message that
+// started its thread, if we have it.
+func (m *model) countReply(tab string, reply receivedMsg) {
+	msgs := m.messages[tab]
+	for i := range msgs {
+		if msgs[i].id != reply.parentID {
+			continue
+		}
+		msgs[i].replies++
+		if len(msgs[i].members) == 0 {
+			msgs[i].members = []string{msgs[i].username}
+		}
+		if !slices.Contains(msgs[i].members, reply.username) {
+			msgs[i].members = append(msgs[i].members, reply.username)
+		}
+		return
+	}
+}
+
+// editLastMessage puts our newest message in the active conversation into
+// the textarea to be edited. It reports false if there is none.
+func (m *model) editLastMessage() bool {
+	if m.conn == nil || m.reconnecting || !m.supports(message.CapEdits) {
+		return false
+	}
+
+	msgs := m.messages[m.activeTab()]
+	for i := len(msgs) - 1; i >= 0; i-- {
+		raw := msgs[i]
+		if raw.system || raw.deleted || raw.id == "" || raw.username != m.username {
+			continue
+		}
+		m.editing = raw.id
+		m.textarea.SetValue(raw.content)
+		return true
+	}
+	return false
+}
+
+// stopEditing abandons the edit in progress.
+func (m *model) stopEditing() {
+	m.editing = ""
+	m.textarea.Reset()
+}
+
+// notifyTyping tells the server we are typing in the active conversation
+// when the textarea changed, at most twice per TypingTimeout. Slash
+// commands are not announced.
+func (m *model) notifyTyping(before string) tea.Cmd {
+	value := m.textarea.Value()
+	if value == before || value == "" || strings.HasPrefix(value, "/") || m.editing != "" {
+		return nil
+	}
+	if m.conn == nil || m.reconnecting || !m.supports(message.CapTyping) || time.Since(m.lastTyping) < message.TypingTimeout/2 {
+		return nil
+	}
+
+	m.lastTyping = time.Now()
+	return typingCmd(m.chatClient, m.conn, m.activeTab())
+}
+
+func newRawMessage(msg receivedMsg) rawMessage {
+	return rawMessage{
+		id:        msg.id,
+		seq:       msg.seq,
+		username:  msg.username,
+		content:   msg.content,
+		timestamp: msg.timestamp,
+		edited:    msg.edited,
+		deleted:   msg.deleted,
+		reactions: msg.reactions,
+		parentID:  msg.parentID,
+		replies:   msg.replies,
+		members:   msg.members,
+		action:    msg.action,
+	}
+}
+
+// insertBySeq adds raw to msgs after the messages the server sent before
+// it, so that messages fetched late, such as the replies of a thread, are
+// shown in order. System lines are left where they are.
+func insertBySeq(msgs []rawMessage, raw rawMessage) []rawMessage {
+	i := len(msgs)
+	for i > 0 && msgs[i-1].seq > raw.seq {
+		i--
+	}
+	return slices.Insert(msgs, i, raw)
+}
+
+// markSeen records the sequence number of a received message. It reports
+// false for messages that were already received, such as ones replayed again
+// after a reconnect.
+func (m *model) markSeen(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	if m.seen[seq] {
+		return false
+	}
+	m.seen[seq] = true
+	m.lastSeq = max(m.lastSeq, seq)
+	return true
+}
+
+// addSystemMessage shows a local notice in the active conversation.
+func (m *model) addSystemMessage(content string) {
+	m.addSystemMessageTo(m.activeTab(), content)
+}
+
+// addSystemMessageTo shows a local notice in the conversation tab.
+func (m *model) addSystemMessageTo(tab string, content string) {
+	m.messages[tab] = append(m.messages[tab], rawMessage{content: content, timestamp: time.Now(), system: true})
+	if tab == m.activeTab() {
+		m.viewport.SetContent(m.renderMessages(tab))
+		m.viewport.GotoBottom()
+	}
+}
+
+// newRequest returns a fresh request ID, remembering that errors about it
+// belong in tab.
+func (m *model) newRequest(tab string) string {
+	m.lastRequestID++
+	id := strconv.Itoa(m.lastRequestID)
+	m.pending[id] = tab
+	return id
+}
+
+// chatTabFor returns the key of the messages map a received message belongs to.
+func (m model) chatTabFor(msg receivedMsg) string {
+	if message.IsChannel(msg.destination) {
+		return msg.destination
+	} else if msg.username == m.username {
+		return msg.destination
+	}
+	return msg.username
 }
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+
+	message "chatui/internal/protocol"
+
+	"github.com/coder/websocket"
+)
+
+func newModel() model {
+	return InitialModel("ws://localhost:8080/chat", nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func update(m model, msg any) model {
+	next, _ := m.Update(msg)
+	return next.(model)
+}
+
+func TestHelloSetsMessageLength(t *testing.T) {
+	m := update(newModel(), helloMsg{version: message.ProtocolVersion, maxLength: 500})
+	if m.textarea.CharLimit != 500 {
+		t.Errorf("CharLimit = %d, want the 500 announced", m.textarea.CharLimit)
+	}
+
+	m = update(m, helloMsg{version: message.ProtocolVersion})
+	if m.textarea.CharLimit != message.MaxMessageLength {
+		t.Errorf("CharLimit = %d without an announced limit, want %d", m.textarea.CharLimit, message.MaxMessageLength)
+	}
+}
+
+func TestServerEndingSessionLogsOut(t *testing.T) {
+	for _, err := range []error{
+		websocket.CloseError{Code: message.CloseSessionReplaced},
+		websocket.CloseError{Code: message.CloseModerated, Reason: "You were kicked"},
+		websocket.CloseError{Code: websocket.StatusPolicyViolation, Reason: "Disconnected for flooding"},
+	} {
+		m := newModel()
+		m.currentView = ViewChat
+		m.username, m.token = "alice", "revoked"
+		m.autoLogin = &Profile{Username: "alice"}
+		m.channels = append(m.channels, "#go")
+		m.messages["#go"] = []rawMessage{{id: "m1", content: "hi"}}
+		m.lastSeq = 7
+
+		m = update(m, disconnectedMsg{err: err})
+		if m.currentView != ViewLogin || m.token != "" || m.autoLogin != nil {
+			t.Errorf("%v: view %v, token %q, auto login %v, want the login view without a session", err, m.currentView, m.token, m.autoLogin)
+		}
+		if len(m.channels) != 1 || len(m.messages) != 0 || m.lastSeq != 0 || m.reconnecting {
+			t.Errorf("%v: the state of the old session was kept", err)
+		}
+		if m.loginHelper == "" {
+			t.Errorf("%v: no reason shown", err)
+		}
+	}
+}
+
+func TestThreadMergedInOrder(t *testing.T) {
+	m := newModel()
+	m.currentView = ViewChat
+	m.messages[message.LobbyChannel] = []rawMessage{
+		{id: "m1", seq: 1, content: "parent"},
+		{id: "m3", seq: 3, content: "second reply", parentID: "m1"},
+		{id: "m5", seq: 5, content: "later"},
+	}
+
+	received := func(id string, seq uint64, parent string) receivedMsg {
+		return receivedMsg{id: id, seq: seq, username: "bob", destination: message.LobbyChannel, parentID: parent}
+	}
+	parent := received("m1", 1, "")
+	parent.replies = 3
+	m = update(m, threadMsg{
+		parent:  parent,
+		replies: []receivedMsg{received("m2", 2, "m1"), received("m3", 3, "m1"), received("m4", 4, "m1")},
+	})
+
+	var got []string
+	for _, raw := range m.messages[message.LobbyChannel] {
+		got = append(got, raw.id)
+	}
+	if want := []string{"m1", "m2", "m3", "m4", "m5"}; !slices.Equal(got, want) {
+		t.Errorf("messages are %v, want %v", got, want)
+	}
+	if m.messages[message.LobbyChannel][0].replies != 3 {
+		t.Error("the parent was not updated")
+	}
+}
@@ -2,9 +2,14 @@ package client
 
 import (
 	"fmt"
+	"slices"
 	"strings"
+	"time"
+
+	message "chatui/internal/protocol"
 
 	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
 )
 
 func (m model) View() string {
@@ -19,32 +24,24 @@ func (m model) View() string {
 
 func (m model) viewLogin() string {
 	titleStyle := lipgloss.NewStyle().
-		Foreground(lipgloss.Color("86")).
+		Foreground(m.theme.Accent).
 		Bold(true).
-		Background(lipgloss.Color("234"))
+		Background(m.theme.Background)
 
 	helperStyle := lipgloss.NewStyle().
-		Foreground(lipgloss.Color("208")).
-		Background(lipgloss.Color("234")).
+		Foreground(m.theme.Warning).
+		Background(m.theme.Background).
 		Italic(true)
 
-	inputStyled := ""
-	if m.usernameInput.Value() == "" {
-		inputStyled = lipgloss.NewStyle().
-			Background(lipgloss.Color("234")).
-			Foreground(lipgloss.Color("240")).
-			Width(20).
-			Render("Username")
-	} else {
-		inputStyled = lipgloss.NewStyle().
-			Background(lipgloss.Color("234")).
-			Foreground(lipgloss.Color("250")).
-			Width(20).
-			Render(m.usernameInput.Value())
-	}
+	inputStyled := m.renderLoginField(m.usernameInput.Value(), "Username", m.loginField == LoginFieldUsername)
+	passwordStyled := m.renderLoginField(strings.Repeat("•", len([]rune(m.passwordInput.Value()))), "Password", m.loginField == LoginFieldPassword)
 
-	leftPadding := (m.width - 30) / 2
-	topPadding := (m.height - 8) / 2
+	hintStyle := lipgloss.NewStyle().
+		Foreground(m.theme.Subtle).
+		Background(m.theme.Background)
+
+	leftPadding := (m.width - 40) / 2
+	topPadding := (m.height - 10) / 2
 
 	if leftPadding < 0 {
 		leftPadding = 0
@@ -54,30 +51,52 @@ func (m model) viewLogin() string {
 	}
 
 	content := fmt.Sprintf(
-		"%s\n\n> %s\n\n%s",
-		titleStyle.Render("Enter your username:"),
+		"%s\n\n%s\n%s\n\n%s\n\n%s",
+		titleStyle.Render("Log in to chat:"),
 		inputStyled,
+		passwordStyled,
+		hintStyle.Render("Enter: log in · Ctrl+R: create account"),
 		helperStyle.Render(m.loginHelper),
 	)
 
 	centered := lipgloss.NewStyle().
 		PaddingTop(topPadding).
 		PaddingLeft(leftPadding).
-		Background(lipgloss.Color("234")).
+		Background(m.theme.Background).
 		Render(content)
 
 	return lipgloss.NewStyle().
-		Background(lipgloss.Color("234")).
+		Background(m.theme.Background).
 		Width(m.width).
 		Height(m.height).
 		Render(centered)
 }
 
+func (m model) renderLoginField(value string, placeholder string, focused bool) string {
+	prompt := "  "
+	if focused {
+		prompt = "> "
+	}
+
+	if value == "" {
+		return prompt + lipgloss.NewStyle().
+			Background(m.theme.Background).
+			Foreground(m.theme.Subtle).
+			Width(20).
+			Render(placeholder)
+	}
+	return prompt + lipgloss.NewStyle().
+		Background(m.theme.Background).
+		Foreground(m.theme.Item).
+		Width(20).
+		Render(value)
+}
+
 func (m model) viewChat() string {
 	chatContent := lipgloss.JoinHorizontal(lipgloss.Top, m.renderSidebar(), m.renderChatArea())
 
 	fullScreenStyle := lipgloss.NewStyle().
-		Background(lipgloss.Color("234")).
+		Background(m.theme.Background).
 		Width(m.width).
 		Height(m.height)
 
@@ -89,50 +108,30 @@ func (m model) renderSidebar() string {
 	contentWidth := sidebarWidth - 2 // account for padding on the sidebar container
 
 	titleStyle := lipgloss.NewStyle().
-		Foreground(lipgloss.Color("86")).
+		Foreground(m.theme.Accent).
 		Bold(true).
-		Background(lipgloss.Color("236")).
+		Background(m.theme.Panel).
 		Padding(0, 1).
 		Width(contentWidth).
 		Align(lipgloss.Center)
 
-	userList.WriteString(titleStyle.Render("Active users  (Tab: focus)") + "\n\n")
+	sectionStyle := lipgloss.NewStyle().
+		Foreground(m.theme.Heading).
+		Background(m.theme.Sidebar).
+		Bold(true).
+		Padding(0, 1).
+		Width(contentWidth)
 
-	for i, user := range m.currentUsers {
-		var line strings.Builder
-		if i == m.currentSelection {
-			itemStyle := lipgloss.NewStyle().
-				Foreground(lipgloss.Color("0")).
-				Background(lipgloss.Color("62")).
-				Bold(true).
-				Padding(0, 1).
-				Width(contentWidth)
-
-			if m.focusedArea == FocusUserList && !m.blinkOn {
-				itemStyle = itemStyle.Foreground(lipgloss.Color("62")).Background(lipgloss.Color("235"))
-			}
+	userList.WriteString(titleStyle.Render("Chats  (Tab: focus)") + "\n\n")
 
-			fmt.Fprintf(&line, "» %s", user)
-			if m.qntNotifications[user] > 0 {
-				fmt.Fprintf(&line, " (%d)", m.qntNotifications[user])
-			}
-			fmt.Fprintf(&userList, "%s\n", itemStyle.Render(line.String()))
-		} else {
-			itemStyle := lipgloss.NewStyle().
-				Foreground(lipgloss.Color("250")).
-				Background(lipgloss.Color("235")).
-				Padding(0, 1).
-				Width(contentWidth)
-
-			fmt.Fprintf(&line, "  %s", user)
-			if m.qntNotifications[user] > 0 {
-				notifStyle := lipgloss.NewStyle().
-					Foreground(lipgloss.Color("208")).
-					Bold(true)
-				fmt.Fprintf(&line, " %s", notifStyle.Render(fmt.Sprintf("(%d)", m.qntNotifications[user])))
-			}
-			fmt.Fprintf(&userList, "%s\n", itemStyle.Render(line.String()))
-		}
+	userList.WriteString(sectionStyle.Render("Channels") + "\n")
+	for i, channel := range m.channels {
+		userList.WriteString(m.renderSidebarItem(channel, i, contentWidth))
+	}
+
+	userList.WriteString("\n" + sectionStyle.Render("Direct messages") + "\n")
+	for i, user := range m.currentUsers {
+		userList.WriteString(m.renderSidebarItem(user, len(m.channels)+i, contentWidth))
 	}
 
 	content := userList.String()
@@ -140,55 +139,314 @@ func (m model) renderSidebar() string {
 	style := lipgloss.NewStyle().
 		Width(sidebarWidth).
 		Height(m.height).
-		Background(lipgloss.Color("235")).
+		Background(m.theme.Sidebar).
 		Padding(1)
 
 	return style.Render(content)
 }
 
+func (m model) renderSidebarItem(name string, index int, contentWidth int) string {
+	var line strings.Builder
+	if index == m.currentSelection {
+		itemStyle := lipgloss.NewStyle().
+			Foreground(m.theme.SelectionText).
+			Background(m.theme.Selection).
+			Bold(true).
+			Padding(0, 1).
+			Width(contentWidth)
+
+		marker := "»"
+		if m.focusedArea == FocusUserList && !m.blinkOn {
+			itemStyle = itemStyle.Foreground(m.theme.Selection).Background(m.theme.Sidebar)
+			if m.plain {
+				marker = "›"
+			}
+		}
+
+		fmt.Fprintf(&line, "%s %s", marker, name)
+		if m.qntNotifications[name] > 0 {
+			fmt.Fprintf(&line, " (%d)", m.qntNotifications[name])
+		}
+		return itemStyle.Render(line.String()) + "\n"
+	}
+
+	itemStyle := lipgloss.NewStyle().
+		Foreground(m.theme.Item).
+		Background(m.theme.Sidebar).
+		Padding(0, 1).
+		Width(contentWidth)
+
+	fmt.Fprintf(&line, "  %s", name)
+	if m.qntNotifications[name] > 0 {
+		notifStyle := lipgloss.NewStyle().
+			Foreground(m.theme.Unread).
+			Bold(true)
+		fmt.Fprintf(&line, " %s", notifStyle.Render(fmt.Sprintf("(%d)", m.qntNotifications[name])))
+	}
+	return itemStyle.Render(line.String()) + "\n"
+}
+
 func (m model) renderMessages(user string) string {
-	msgs := m.messages[user]
+	var shown []string
+	for _, block := range m.renderMessageBlocks(user) {
+		if block != "" {
+			shown = append(shown, block)
+		}
+	}
+	return strings.Join(shown, "\n")
+}
+
+// renderMessageBlocks renders each message of a conversation, with its
+// reactions, separately. Replies are left empty, as they are only shown in
+// the thread pane.
+func (m model) renderMessageBlocks(user string) []string {
+	return m.renderMessageList(m.messages[user], user, m.viewport.Width, false)
+}
+
+// renderMessageList renders msgs, sent to user, at the given width. Outside
+// of a thread, replies are rendered as empty strings and the messages that
+// start a thread are followed by their reply count.
+func (m model) renderMessageList(msgs []rawMessage, user string, width int, inThread bool) []string {
 	contentStyle := lipgloss.NewStyle().
-		Background(lipgloss.Color("234")).
-		Foreground(lipgloss.Color("252"))
+		Background(m.theme.Background).
+		Foreground(m.theme.Text)
 	lineStyle := lipgloss.NewStyle().
-		Background(lipgloss.Color("234")).
-		Width(m.viewport.Width)
+		Background(m.theme.Background).
+		Width(width)
+	systemStyle := lipgloss.NewStyle().
+		Background(m.theme.Background).
+		Foreground(m.theme.Dim).
+		Italic(true)
+	timeStyle := lipgloss.NewStyle().
+		Background(m.theme.Background).
+		Foreground(m.theme.Subtle)
+	selectedStyle := lipgloss.NewStyle().
+		Background(m.theme.Accent).
+		Foreground(m.theme.Background)
+	threadStyle := lipgloss.NewStyle().
+		Background(m.theme.Background).
+		Foreground(m.theme.Accent)
+	indent := timeStyle.Render(strings.Repeat(" ", 6))
+	now := time.Now()
 	var rendered []string
-	for _, raw := range msgs {
-		styled := m.senderStyle.Render(raw.username+":") + contentStyle.Render(" "+raw.content)
+	for i, raw := range msgs {
+		if raw.parentID != "" && !inThread {
+			rendered = append(rendered, "")
+			continue
+		}
+		stamp := timeStyle.Render(m.formatTimestamp(raw.timestamp, now) + " ")
+		if m.focusedArea == FocusMessages && i == m.selected && !inThread {
+			marker := " "
+			if m.plain {
+				marker = "»"
+			}
+			stamp = selectedStyle.Render(m.formatTimestamp(raw.timestamp, now)) + timeStyle.Render(marker)
+		}
+		if raw.system {
+			rendered = append(rendered, lineStyle.Render(stamp+systemStyle.Render("* "+raw.content)))
+			continue
+		}
+		styled := stamp + m.senderStyle.Render(raw.username+":")
+		if raw.action {
+			styled = stamp + contentStyle.Render("* ") + m.senderStyle.Render(raw.username)
+		}
+		switch {
+		case raw.deleted:
+			styled += systemStyle.Render(" message deleted")
+		case raw.edited:
+			styled += contentStyle.Render(" "+raw.content) + timeStyle.Render(" (edited)")
+		case raw.action:
+			styled += contentStyle.Italic(true).Render(" " + raw.content)
+		default:
+			styled += contentStyle.Render(" " + raw.content)
+		}
+		if raw.username == m.username && !message.IsChannel(user) {
+			styled += m.renderReceipt(raw.status)
+		}
+		if len(raw.reactions) > 0 && !raw.deleted {
+			styled += "\n" + indent + m.renderReactions(raw.reactions)
+		}
+		if raw.replies > 0 && !inThread {
+			styled += "\n" + indent + threadStyle.Render(pluralize(raw.replies, "reply", "replies"))
+		}
 		rendered = append(rendered, lineStyle.Render(styled))
 	}
-	return strings.Join(rendered, "\n")
+	return rendered
+}
+
+func pluralize(n int, one string, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// renderThread renders the pane showing the open thread: the message that
+// started it followed by its replies, keeping the newest ones in view.
+func (m model) renderThread(width int, height int) string {
+	tab := m.threadTab
+	var msgs []rawMessage
+	for _, raw := range m.messages[tab] {
+		if raw.id == m.thread {
+			msgs = append([]rawMessage{raw}, msgs...)
+		} else if raw.parentID == m.thread {
+			msgs = append(msgs, raw)
+		}
+	}
+	// Replies fetched when opening the thread may be older than ones
+	// already received.
+	replies := msgs
+	if len(msgs) > 0 && msgs[0].id == m.thread {
+		replies = msgs[1:]
+	}
+	slices.SortStableFunc(replies, func(a, b rawMessage) int { return a.timestamp.Compare(b.timestamp) })
+
+	headerStyle := lipgloss.NewStyle().
+		Background(m.theme.Background).
+		Foreground(m.theme.Accent).
+		Bold(true).
+		Width(width).
+		MaxHeight(1)
+	header := "Thread"
+	if len(msgs) > 0 && msgs[0].id == m.thread {
+		header += " · " + pluralize(msgs[0].replies, "reply", "replies")
+		if len(msgs[0].members) > 0 {
+			header += " · " + strings.Join(msgs[0].members, ", ")
+		}
+	}
+
+	lines := strings.Split(strings.Join(m.renderMessageList(msgs, tab, width, true), "\n"), "\n")
+	if len(lines) > height-1 {
+		lines = lines[len(lines)-(height-1):]
+	}
+	return headerStyle.Render(header) + "\n" + strings.Join(lines, "\n")
+}
+
+// renderReactions shows compact counters such as "👍 3 🎉 1", most used
+// first, highlighting the ones we reacted with.
+func (m model) renderReactions(reactions map[string][]string) string {
+	emojis := make([]string, 0, len(reactions))
+	for emoji := range reactions {
+		emojis = append(emojis, emoji)
+	}
+	slices.SortFunc(emojis, func(a, b string) int {
+		if n := len(reactions[b]) - len(reactions[a]); n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+
+	style := lipgloss.NewStyle().
+		Background(m.theme.Background).
+		Foreground(m.theme.Dim)
+	ownStyle := style.Foreground(m.theme.Accent)
+
+	counters := make([]string, 0, len(emojis))
+	for _, emoji := range emojis {
+		counter := fmt.Sprintf("%s %d", emoji, len(reactions[emoji]))
+		if slices.Contains(reactions[emoji], m.username) {
+			counters = append(counters, ownStyle.Render(counter))
+		} else {
+			counters = append(counters, style.Render(counter))
+		}
+	}
+	return strings.Join(counters, style.Render(" "))
+}
+
+// renderReceipt shows whether a direct message we sent is queued for an
+// offline user, was delivered (✓) or read (✓✓).
+func (m model) renderReceipt(status message.ReceiptStatus) string {
+	style := lipgloss.NewStyle().Background(m.theme.Background)
+	switch status {
+	case message.ReceiptRead:
+		return style.Foreground(m.theme.Accent).Render(" ✓✓")
+	case message.ReceiptDelivered:
+		return style.Foreground(m.theme.Dim).Render(" ✓")
+	case message.ReceiptQueued:
+		return style.Foreground(m.theme.Subtle).Italic(true).Render(" (queued)")
+	default:
+		return ""
+	}
+}
+
+// formatTimestamp renders when a message was sent, either as local wall
+// clock time or relative to now.
+func (m model) formatTimestamp(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "     "
+	}
+
+	if m.relativeTime {
+		elapsed := now.Sub(t)
+		switch {
+		case elapsed < time.Minute:
+			return "  now"
+		case elapsed < time.Hour:
+			return fmt.Sprintf("%4dm", int(elapsed.Minutes()))
+		case elapsed < time.Hour*24:
+			return fmt.Sprintf("%4dh", int(elapsed.Hours()))
+		default:
+			return fmt.Sprintf("%4dd", int(elapsed.Hours()/24))
+		}
+	}
+
+	local := t.Local()
+	y, mo, d := now.Date()
+	ly, lmo, ld := local.Date()
+	if y == ly && mo == lmo && d == ld {
+		return local.Format("15:04")
+	}
+	return local.Format("Jan 2 15:04")
 }
 
 func (m model) renderChatArea() string {
 	chatWidth := m.width - sidebarWidth
 
-	m.viewport.Style = lipgloss.NewStyle().Background(lipgloss.Color("234"))
+	m.viewport.Style = lipgloss.NewStyle().Background(m.theme.Background)
 
+	mainWidth := chatWidth
+	if m.thread != "" {
+		mainWidth -= m.threadWidth()
+	}
 	vpStyle := lipgloss.NewStyle().
-		Width(chatWidth).
+		Width(mainWidth).
 		Height(m.viewport.Height).
-		Background(lipgloss.Color("234")).
+		Background(m.theme.Background).
 		Padding(0, 1)
+	messages := vpStyle.Render(m.viewport.View())
+	if m.thread != "" {
+		threadStyle := lipgloss.NewStyle().
+			Width(m.threadWidth()-1).
+			Height(m.viewport.Height).
+			Background(m.theme.Background).
+			Padding(0, 1).
+			BorderStyle(lipgloss.NormalBorder()).
+			BorderLeft(true).
+			BorderForeground(m.theme.Subtle).
+			BorderBackground(m.theme.Background)
+		thread := m.renderThread(m.threadWidth()-3, m.viewport.Height)
+		messages = lipgloss.JoinHorizontal(lipgloss.Top, messages, threadStyle.Render(thread))
+	}
 
-	taHeight := m.height - m.viewport.Height
+	taHeight := m.height - m.viewport.Height - statusLineHeight
 	if taHeight < 0 {
 		taHeight = 0
 	}
 
 	taWidth := chatWidth - 2
 
-	bgSeq := "\x1b[48;5;236m"
-	resetSeq := "\x1b[0m"
-
+	// The textarea resets the terminal after each of its styled parts,
+	// which would show the terminal's own background until the end of the
+	// line; set the panel background again after every reset.
 	m.textarea.Focus()
 	taContent := m.textarea.View()
-	taContent = bgSeq + strings.ReplaceAll(taContent, resetSeq, resetSeq+bgSeq) + resetSeq
+	if bgSeq := backgroundSequence(m.theme.Panel); bgSeq != "" {
+		resetSeq := termenv.CSI + termenv.ResetSeq + "m"
+		taContent = bgSeq + strings.ReplaceAll(taContent, resetSeq, resetSeq+bgSeq) + resetSeq
+	}
 
 	taLines := strings.Split(taContent, "\n")
-	lineStyle := lipgloss.NewStyle().Background(lipgloss.Color("236")).Width(taWidth)
+	lineStyle := lipgloss.NewStyle().Background(m.theme.Panel).Width(taWidth)
 	for i, line := range taLines {
 		taLines[i] = lineStyle.Render(line)
 	}
@@ -201,11 +459,89 @@ func (m model) renderChatArea() string {
 	taStyle := lipgloss.NewStyle().
 		Width(chatWidth).
 		Height(taHeight).
-		Background(lipgloss.Color("236")).
+		Background(m.theme.Panel).
 		Padding(0, 1)
 
 	return lipgloss.JoinVertical(lipgloss.Left,
-		vpStyle.Render(m.viewport.View()),
+		messages,
+		m.renderStatusLine(chatWidth),
 		taStyle.Render(filledTA),
 	)
 }
+
+// statusLineHeight is the number of rows between the viewport and the
+// textarea used by renderStatusLine.
+const statusLineHeight = 1
+
+func (m model) renderStatusLine(width int) string {
+	style := lipgloss.NewStyle().
+		Width(width).
+		Background(m.theme.Background).
+		Padding(0, 1)
+
+	if m.reconnecting {
+		return style.
+			Foreground(m.theme.Warning).
+			Italic(true).
+			Render("Connection lost, reconnecting…")
+	}
+
+	if len(m.completions) > 0 {
+		return style.
+			Foreground(m.theme.Dim).
+			Render(strings.Join(m.completions, "  "))
+	}
+
+	if m.focusedArea == FocusMessages {
+		keys := make([]string, len(reactionEmojis))
+		for i, emoji := range reactionEmojis {
+			keys[i] = fmt.Sprintf("%d %s", i+1, emoji)
+		}
+		return style.
+			Foreground(m.theme.Accent).
+			Render("React: " + strings.Join(keys, "  ") + " · Enter: thread · ↑/↓ pick · Esc done")
+	}
+
+	if m.editing != "" {
+		return style.
+			Foreground(m.theme.Accent).
+			Render("Editing message: Enter saves, an empty message deletes it, Esc cancels")
+	}
+
+	if typing := m.typingUsers(m.activeTab()); len(typing) > 0 {
+		var text string
+		switch len(typing) {
+		case 1:
+			text = typing[0] + " is typing…"
+		case 2:
+			text = typing[0] + " and " + typing[1] + " are typing…"
+		default:
+			text = "Several people are typing…"
+		}
+		return style.
+			Foreground(m.theme.Dim).
+			Italic(true).
+			Render(text)
+	}
+
+	if m.thread != "" {
+		return style.
+			Foreground(m.theme.Accent).
+			Render("Replying in thread · Esc closes it")
+	}
+
+	return style.Render("")
+}
+
+// typingUsers returns, sorted, the users currently typing in tab.
+func (m model) typingUsers(tab string) []string {
+	now := time.Now()
+	var users []string
+	for user, expires := range m.typing[tab] {
+		if now.Before(expires) {
+			users = append(users, user)
+		}
+	}
+	slices.Sort(users)
+	return users
+}
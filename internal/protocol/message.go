@@ -1,7 +1,12 @@
 // Package message defines the structures for different types of messages in the chat application.
 package message
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+)
 
 type MessageType string
 
@@ -10,32 +15,405 @@ const (
 	TypeLoginResponse  MessageType = "login_response"
 	TypeUserListUpdate MessageType = "user_list_update"
 	TypeLoginRequest   MessageType = "login_request"
+	TypeHistory        MessageType = "history"
+	TypeTyping         MessageType = "typing"
+	TypeReceipt        MessageType = "receipt"
+	TypeError          MessageType = "error"
+	TypeHello          MessageType = "hello"
+	TypeMessageEdit    MessageType = "message_edit"
+	TypeMessageDelete  MessageType = "message_delete"
+	TypeReaction       MessageType = "reaction"
+	TypeThread         MessageType = "thread"
+	TypeModeration     MessageType = "moderation"
+	TypeNotice         MessageType = "notice"
+
+	TypeChannelCreate   MessageType = "channel_create"
+	TypeChannelJoin     MessageType = "channel_join"
+	TypeChannelLeave    MessageType = "channel_leave"
+	TypeChannelList     MessageType = "channel_list"
+	TypeChannelResponse MessageType = "channel_response"
+)
+
+const (
+	// ProtocolVersion is the version of the protocol described here.
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version still understood.
+	MinProtocolVersion = 1
+)
+
+// Capability names an optional part of the protocol. Peers only send the
+// message types of capabilities both sides announced in their Hello.
+type Capability string
+
+const (
+	CapHistory    Capability = "history"
+	CapChannels   Capability = "channels"
+	CapTyping     Capability = "typing"
+	CapReceipts   Capability = "receipts"
+	CapErrors     Capability = "errors"
+	CapEdits      Capability = "edits"
+	CapReactions  Capability = "reactions"
+	CapThreads    Capability = "threads"
+	CapModeration Capability = "moderation"
+	CapNotices    Capability = "notices"
 )
 
+// Capabilities lists every capability this version of the package supports.
+var Capabilities = []Capability{CapHistory, CapChannels, CapTyping, CapReceipts, CapErrors, CapEdits, CapReactions, CapThreads, CapModeration, CapNotices}
+
+// Hello is the first envelope a client sends, before logging in, and the
+// server's reply to it. The reply carries the version both sides will speak
+// and the capabilities they have in common. Clients that send no Hello are
+// treated as speaking the original protocol without any capability.
+type Hello struct {
+	Version      int          `json:"version"`
+	Capabilities []Capability `json:"capabilities"`
+	// Commands lists, in the server's reply, the slash commands answered by
+	// bots running on the server. They are sent as ordinary chat messages.
+	Commands []CommandInfo `json:"commands,omitempty"`
+	// MaxMessageLength is, in the server's reply, the most characters a
+	// chat message may have. Zero means MaxMessageLength.
+	MaxMessageLength int `json:"max_message_length,omitempty"`
+}
+
+// CommandInfo describes a slash command, such as "/roll", handled by the
+// server.
+type CommandInfo struct {
+	Name  string `json:"name"`
+	Usage string `json:"usage,omitempty"`
+	Help  string `json:"help,omitempty"`
+}
+
+// Negotiate returns the capabilities present in both ours and theirs.
+func Negotiate(ours []Capability, theirs []Capability) []Capability {
+	common := []Capability{}
+	for _, c := range ours {
+		if slices.Contains(theirs, c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+// RequiredCapability returns the capability a peer must support to be sent
+// an envelope of type t, or an empty string for the types every client
+// understands.
+func RequiredCapability(t MessageType) Capability {
+	switch t {
+	case TypeHistory:
+		return CapHistory
+	case TypeChannelCreate, TypeChannelJoin, TypeChannelLeave, TypeChannelList, TypeChannelResponse:
+		return CapChannels
+	case TypeTyping:
+		return CapTyping
+	case TypeReceipt:
+		return CapReceipts
+	case TypeError:
+		return CapErrors
+	case TypeMessageEdit, TypeMessageDelete:
+		return CapEdits
+	case TypeReaction:
+		return CapReactions
+	case TypeThread:
+		return CapThreads
+	case TypeModeration:
+		return CapModeration
+	case TypeNotice:
+		return CapNotices
+	default:
+		return ""
+	}
+}
+
+// CloseSessionReplaced is the websocket close code sent to a connection
+// whose user logged in again elsewhere. Clients should not reconnect
+// automatically after receiving it.
+const CloseSessionReplaced = 4001
+
+// CloseModerated is the websocket close code sent to a user who was kicked
+// or banned. The close reason says why.
+const CloseModerated = 4002
+
+// LobbyChannel is the channel every user belongs to. It cannot be left.
+const LobbyChannel = "ALL"
+
+// ChannelPrefix starts the name of every channel other than the lobby.
+const ChannelPrefix = "#"
+
+// IsChannel reports whether a ChatMessage destination names a channel rather
+// than a user.
+func IsChannel(destination string) bool {
+	return destination == LobbyChannel || strings.HasPrefix(destination, ChannelPrefix)
+}
+
+// Envelope wraps every message sent over the websocket. A client may set
+// RequestID on what it sends; the server copies it onto the responses and
+// errors caused by that envelope, including the echo of a chat message.
 type Envelope struct {
-	Type MessageType     `json:"type"`
-	Data json.RawMessage `json:"data"`
+	Type      MessageType     `json:"type"`
+	RequestID string          `json:"request_id,omitempty"`
+	Data      json.RawMessage `json:"data"`
 }
 
+type ErrorCode string
+
+const (
+	ErrorBadRequest         ErrorCode = "bad_request"
+	ErrorUnknownType        ErrorCode = "unknown_type"
+	ErrorMessageTooLong     ErrorCode = "message_too_long"
+	ErrorEmptyMessage       ErrorCode = "empty_message"
+	ErrorUnknownDestination ErrorCode = "unknown_destination"
+	ErrorNotMember          ErrorCode = "not_a_member"
+	ErrorUnsupportedVersion ErrorCode = "unsupported_version"
+	ErrorUnknownMessage     ErrorCode = "unknown_message"
+	ErrorForbidden          ErrorCode = "forbidden"
+	ErrorUnauthorized       ErrorCode = "unauthorized"
+	ErrorRateLimited        ErrorCode = "rate_limited"
+	ErrorMuted              ErrorCode = "muted"
+)
+
+// Error reports that the server could not act on an envelope. Code is meant
+// for programs, Message for people.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// MaxMessageLength is the longest ChatMessage.Message the server accepts,
+// unless configured otherwise.
+const MaxMessageLength = 200
+
+// ChatMessage is a line of chat. ID, Timestamp, Seq and ConversationSeq are
+// assigned by the server; whatever the client sends in them is ignored.
 type ChatMessage struct {
-	Username    string `json:"username"`
-	Destination string `json:"destination"`
+	ID          string    `json:"id,omitempty"`
+	Username    string    `json:"username"`
+	Destination string    `json:"destination"`
+	Message     string    `json:"message"`
+	Timestamp   time.Time `json:"timestamp,omitzero"`
+	// Seq increases with every message the server delivers, across all
+	// conversations.
+	Seq uint64 `json:"seq,omitempty"`
+	// ConversationSeq increases with every message in the same channel or
+	// between the same two users.
+	ConversationSeq uint64 `json:"conversation_seq,omitempty"`
+	// Edited is set once the author changed Message after sending it.
+	Edited bool `json:"edited,omitempty"`
+	// Deleted is set, and Message cleared, when the message was removed.
+	Deleted bool `json:"deleted,omitempty"`
+	// Reactions maps each emoji reacted with to the users who did, in the
+	// order they reacted.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// ParentID makes the message a reply in the thread started by another
+	// message of the same conversation. Replies to a reply join the thread
+	// of its parent.
+	ParentID string `json:"parent_id,omitempty"`
+	// Replies and ThreadMembers are kept up to date by the server on the
+	// message that started a thread: how many replies it has and who took
+	// part in it, starting with its author.
+	Replies       int      `json:"replies,omitempty"`
+	ThreadMembers []string `json:"thread_members,omitempty"`
+	// Action marks a message describing what its author does, sent with
+	// "/me", which clients show as "* alice waves".
+	Action bool `json:"action,omitempty"`
+}
+
+// ThreadRequest asks for the thread started by the message ParentID.
+type ThreadRequest struct {
+	ParentID string `json:"parent_id"`
+}
+
+// Thread answers a ThreadRequest with the message that started the thread
+// and its replies, oldest first.
+type Thread struct {
+	Parent  ChatMessage   `json:"parent"`
+	Replies []ChatMessage `json:"replies"`
+}
+
+// Role decides which moderation actions a user may take.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// AtLeast reports whether r grants everything other does.
+func (r Role) AtLeast(other Role) bool {
+	return r.rank() >= other.rank()
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleAdmin:
+		return 2
+	case RoleModerator:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type ModerationAction string
+
+const (
+	// Moderators may kick, mute and unmute users with a lower role.
+	ModerationKick   ModerationAction = "kick"
+	ModerationMute   ModerationAction = "mute"
+	ModerationUnmute ModerationAction = "unmute"
+	// Admins may also ban and unban usernames or IP addresses, and change
+	// roles.
+	ModerationBan   ModerationAction = "ban"
+	ModerationUnban ModerationAction = "unban"
+	ModerationRole  ModerationAction = "role"
+)
+
+// Moderation is a moderation request sent by a client. Target is a username,
+// or an IP address for bans. Duration, such as "10m", bounds mutes and bans;
+// bans without one are permanent. Role is the new role of a role change.
+type Moderation struct {
+	Action   ModerationAction `json:"action"`
+	Target   string           `json:"target"`
+	Duration string           `json:"duration,omitempty"`
+	Reason   string           `json:"reason,omitempty"`
+	Role     Role             `json:"role,omitempty"`
+}
+
+// Notice is a message from the server itself, such as the outcome of a
+// moderation action, meant to be shown to the user as is.
+type Notice struct {
+	Message string `json:"message"`
+}
+
+// MessageEdit replaces the text of the message with the given ID. Clients
+// send ID and Message; the server fills in the Username and Destination of
+// the original message when passing the change on to its audience.
+type MessageEdit struct {
+	ID          string `json:"id"`
+	Username    string `json:"username,omitempty"`
+	Destination string `json:"destination,omitempty"`
 	Message     string `json:"message"`
 }
 
+// MessageDelete removes the message with the given ID. As with MessageEdit,
+// Username and Destination are filled in by the server.
+type MessageDelete struct {
+	ID          string `json:"id"`
+	Username    string `json:"username,omitempty"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// MaxEmojiLength is the longest Reaction.Emoji, in bytes, the server accepts.
+const MaxEmojiLength = 32
+
+// Reaction adds Username's Emoji to the message MessageID or, with Remove,
+// takes it back. Clients send MessageID, Emoji and Remove. The server fills
+// in the rest, including the updated Reactions of the message, before
+// passing it on to the message's audience.
+type Reaction struct {
+	MessageID   string              `json:"message_id"`
+	Username    string              `json:"username,omitempty"`
+	Author      string              `json:"author,omitempty"`
+	Destination string              `json:"destination,omitempty"`
+	Emoji       string              `json:"emoji"`
+	Remove      bool                `json:"remove,omitempty"`
+	Reactions   map[string][]string `json:"reactions,omitempty"`
+}
+
+// LoginRequest authenticates with either Password or a Token returned by an
+// earlier LoginResponse. When Register is set, a new account is created with
+// Password instead. A client resuming a dropped session sets LastSeq to the
+// highest ChatMessage.Seq it received, and is sent everything newer.
 type LoginRequest struct {
 	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Register bool   `json:"register,omitempty"`
+	LastSeq  uint64 `json:"last_seq,omitempty"`
 }
 
+// LoginResponse carries, on success, the Username the server assigned, which
+// differs from the requested one when a client certificate is used, and a
+// session Token that can be sent in a later LoginRequest instead of the
+// password.
 type LoginResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message,omitempty"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message,omitempty"`
+	Username string `json:"username,omitempty"`
+	Token    string `json:"token,omitempty"`
 }
 
 type UserListUpdate struct {
 	Users []string `json:"users"`
 }
 
+// ChannelRequest asks the server to create, join or leave a channel, or,
+// with an empty Channel, to send the channel list.
+type ChannelRequest struct {
+	Channel string `json:"channel,omitempty"`
+}
+
+// ChannelResponse tells the client whether a ChannelRequest succeeded.
+type ChannelResponse struct {
+	Channel string `json:"channel"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+type ChannelInfo struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Joined  bool     `json:"joined"`
+}
+
+// ChannelList is sent whenever the set of channels or their membership
+// changes. Joined is set on the channels the receiving user belongs to.
+type ChannelList struct {
+	Channels []ChannelInfo `json:"channels"`
+}
+
+// Typing tells the members of a conversation that Username is writing a
+// message to Destination. Clients send it periodically while the user types
+// and treat it as stale after TypingTimeout. Username is filled in by the
+// server.
+type Typing struct {
+	Username    string `json:"username"`
+	Destination string `json:"destination"`
+}
+
+// TypingTimeout is how long a Typing notification is shown for.
+const TypingTimeout = time.Second * 5
+
+type ReceiptStatus string
+
+const (
+	// ReceiptQueued means the reader is offline and will be sent the
+	// message when they next log in.
+	ReceiptQueued    ReceiptStatus = "queued"
+	ReceiptDelivered ReceiptStatus = "delivered"
+	ReceiptRead      ReceiptStatus = "read"
+)
+
+// Receipt reports that the direct message MessageID, sent by Sender, was
+// queued for, delivered to or read by Reader. The server sends delivered
+// receipts once the message reaches the reader's connection. Clients send
+// read receipts for the newest message they have seen from Sender, which
+// covers every earlier one. The server fills in Reader and forwards them to
+// Sender if the message was sent to Reader.
+type Receipt struct {
+	MessageID string        `json:"message_id"`
+	Sender    string        `json:"sender"`
+	Reader    string        `json:"reader"`
+	Status    ReceiptStatus `json:"status"`
+}
+
+// History carries previously delivered messages, oldest first, so a user who
+// just logged in can see what was said before they joined.
+type History struct {
+	Messages []ChatMessage `json:"messages"`
+}
+
 func MakeEnvelope(msgType MessageType, msg any) Envelope {
 	return Envelope{
 		Type: msgType,
@@ -45,3 +423,11 @@ func MakeEnvelope(msgType MessageType, msg any) Envelope {
 		}(),
 	}
 }
+
+// MakeReply is like MakeEnvelope, for a response to the envelope the client
+// tagged with requestID.
+func MakeReply(requestID string, msgType MessageType, msg any) Envelope {
+	envelope := MakeEnvelope(msgType, msg)
+	envelope.RequestID = requestID
+	return envelope
+}
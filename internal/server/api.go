@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	message "chatui/internal/protocol"
+)
+
+// maxAPIBody bounds the size of a request to the HTTP API.
+const maxAPIBody = 64 * 1024
+
+// LoadAPIKeys reads the keys allowed to use the HTTP API from path, a JSON
+// object mapping a name to its key. Messages sent with a key are posted as
+// its name, which users can then no longer log in as.
+func LoadAPIKeys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("reading API keys from %s: %w", path, err)
+	}
+	for name, key := range keys {
+		if name == "" || len(name) > 32 || message.IsChannel(name) {
+			return nil, fmt.Errorf("invalid API key name %q", name)
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("the API key of %s must be at least 16 characters long", name)
+		}
+	}
+	return keys, nil
+}
+
+// SetAPIKeys enables the HTTP API for the given keys, mapping a name to its
+// key. It must be called before the server handles requests.
+func (cs *ChatServer) SetAPIKeys(keys map[string]string) {
+	cs.apiKeys = keys
+}
+
+// isAPIUser reports whether username is the name of an API key.
+func (cs ChatServer) isAPIUser(username string) bool {
+	_, ok := cs.apiKeys[username]
+	return ok
+}
+
+// authenticateAPI returns the name of the key the request carries as a
+// bearer token.
+func (cs ChatServer) authenticateAPI(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	for name, key := range cs.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// APIMessage is the body of a POST /api/messages request.
+type APIMessage struct {
+	Destination string `json:"destination"`
+	Message     string `json:"message"`
+	ParentID    string `json:"parent_id,omitempty"`
+}
+
+// APIHandler returns the handler of the HTTP API, to be mounted at /api/.
+func (cs *ChatServer) APIHandler() http.Handler {
+	return http.HandlerFunc(cs.serveAPI)
+}
+
+// serveAPI answers the HTTP API under /api/. Errors are returned as a
+// message.Error.
+func (cs ChatServer) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/messages" {
+		writeAPIError(w, http.StatusNotFound, message.ErrorBadRequest, "Not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, message.ErrorBadRequest, "Use POST")
+		return
+	}
+
+	name, ok := cs.authenticateAPI(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, message.ErrorUnauthorized, "Missing or invalid API key")
+		return
+	}
+
+	// Every key is limited like a user, and shares the limit of its address.
+	if !cs.limits.allow(rateMessages, name, remoteIP(r)) {
+		cs.log.Warn("API key over the rate limit", "api_user", name, "remote_addr", remoteIP(r))
+		writeAPIError(w, http.StatusTooManyRequests, message.ErrorRateLimited, "Rate limited, slow down")
+		return
+	}
+
+	var req APIMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, message.ErrorBadRequest, "Malformed message")
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		writeAPIError(w, http.StatusBadRequest, message.ErrorEmptyMessage, "Message cannot be empty")
+		return
+	}
+	if limit := cs.options.Load().MaxMessageLength; utf8.RuneCountInString(req.Message) > limit {
+		writeAPIError(w, http.StatusBadRequest, message.ErrorMessageTooLong,
+			fmt.Sprintf("Message cannot be longer than %d characters", limit))
+		return
+	}
+
+	result := make(chan chatResult, 1)
+	submit(cs.hub.metrics, "broadcast", cs.hub.broadcast, chatRequest{
+		msg: message.ChatMessage{
+			ID:          newMessageID(),
+			Username:    name,
+			Destination: req.Destination,
+			Message:     req.Message,
+			Timestamp:   time.Now().UTC(),
+			ParentID:    req.ParentID,
+		},
+		result: result,
+	})
+
+	var res chatResult
+	select {
+	case res = <-result:
+	case <-r.Context().Done():
+		return
+	}
+	if res.code != "" {
+		writeAPIError(w, apiStatus(res.code), res.code, res.reason)
+		return
+	}
+
+	cs.log.Info("message posted through the API", "api_user", name, "id", res.msg.ID, "destination", res.msg.Destination)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res.msg)
+}
+
+// apiStatus returns the HTTP status matching an error code of the hub.
+func apiStatus(code message.ErrorCode) int {
+	switch code {
+	case message.ErrorUnknownDestination, message.ErrorUnknownMessage:
+		return http.StatusNotFound
+	case message.ErrorForbidden, message.ErrorNotMember:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code message.ErrorCode, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(message.Error{Code: code, Message: reason})
+}
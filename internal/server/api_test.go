@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+const testAPIKey = "0123456789abcdef"
+
+// startAPI returns a running hub and a server accepting testAPIKey as "ci".
+func startAPI(t *testing.T) (*Hub, *ChatServer) {
+	t.Helper()
+	hub := startHub(t)
+	cs := CreateChatServer(discard, hub, nil)
+	cs.SetAPIKeys(map[string]string{"ci": testAPIKey})
+	return hub, cs
+}
+
+// postAPI sends body to POST /api/messages with the given Authorization
+// header, and decodes the answer into v.
+func postAPI(t *testing.T, cs *ChatServer, auth string, body string, v any) int {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(body))
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	cs.APIHandler().ServeHTTP(w, r)
+
+	if v != nil {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("decoding the answer: %v", err)
+		}
+	}
+	return w.Code
+}
+
+func TestAPIRejectsBadKeys(t *testing.T) {
+	_, cs := startAPI(t)
+	body := `{"destination": "ALL", "message": "hi"}`
+
+	for _, auth := range []string{"", "Bearer ", "Bearer wrong-key-0123456789", "Basic " + testAPIKey, testAPIKey} {
+		var resp message.Error
+		if code := postAPI(t, cs, auth, body, &resp); code != http.StatusUnauthorized || resp.Code != message.ErrorUnauthorized {
+			t.Errorf("Authorization %q: got %d %+v, want 401", auth, code, resp)
+		}
+	}
+}
+
+func TestAPIPostsMessage(t *testing.T) {
+	hub, cs := startAPI(t)
+	alice := connect(t, hub, "alice")
+
+	var posted message.ChatMessage
+	code := postAPI(t, cs, "Bearer "+testAPIKey, `{"destination": "ALL", "message": "build failed"}`, &posted)
+	if code != http.StatusCreated {
+		t.Fatalf("got %d, want 201", code)
+	}
+	if posted.ID == "" || posted.Seq == 0 || posted.Username != "ci" || posted.Message != "build failed" {
+		t.Errorf("answered %+v", posted)
+	}
+
+	got := expect[message.ChatMessage](t, alice, message.TypeChatMessage)
+	if got.ID != posted.ID || got.Username != "ci" || got.Destination != message.LobbyChannel {
+		t.Errorf("alice got %+v, want %+v", got, posted)
+	}
+	if !cs.isAPIUser("ci") {
+		t.Error("the name of a key can be logged in as")
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	_, cs := startAPI(t)
+	auth := "Bearer " + testAPIKey
+
+	for _, tt := range []struct {
+		body   string
+		status int
+		code   message.ErrorCode
+	}{
+		{`{"destination": "ALL"`, http.StatusBadRequest, message.ErrorBadRequest},
+		{`{"destination": "ALL", "message": "  "}`, http.StatusBadRequest, message.ErrorEmptyMessage},
+		{`{"destination": "#nowhere", "message": "hi"}`, http.StatusNotFound, message.ErrorUnknownDestination},
+		{`{"destination": "nobody", "message": "hi"}`, http.StatusNotFound, message.ErrorUnknownDestination},
+	} {
+		var resp message.Error
+		if code := postAPI(t, cs, auth, tt.body, &resp); code != tt.status || resp.Code != tt.code {
+			t.Errorf("%s: got %d %+v, want %d %s", tt.body, code, resp, tt.status, tt.code)
+		}
+	}
+}
+
+func TestAPIRateLimit(t *testing.T) {
+	_, cs := startAPI(t)
+	limits := DefaultRateLimitOptions
+	limits.Messages = RateLimit{Count: 2, Per: time.Hour}
+	cs.SetRateLimits(limits)
+
+	body := `{"destination": "ALL", "message": "hi"}`
+	for i := range 2 {
+		if code := postAPI(t, cs, "Bearer "+testAPIKey, body, nil); code != http.StatusCreated {
+			t.Fatalf("post %d: got %d, want 201", i, code)
+		}
+	}
+
+	var resp message.Error
+	if code := postAPI(t, cs, "Bearer "+testAPIKey, body, &resp); code != http.StatusTooManyRequests || resp.Code != message.ErrorRateLimited {
+		t.Errorf("got %d %+v, want 429", code, resp)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+// Bot is a plugin running inside the server as a virtual user. Bots are
+// listed in the user list like connected users, can be sent direct messages
+// and may post in every channel.
+type Bot interface {
+	// Name is the username the bot posts as.
+	Name() string
+	// Commands returns the slash commands the bot answers. Clients are told
+	// about them when they connect.
+	Commands() []BotCommand
+	// Start is called once, before the bot is given any message, with the
+	// host it posts through. Bots acting on their own, on a timer for
+	// instance, start their goroutines here.
+	Start(host BotHost)
+	// Observe is called with every message delivered by the hub, except
+	// the bot's own, in the order they were delivered. It runs on a
+	// goroutine of its own, so a slow bot does not hold up the chat.
+	Observe(msg message.ChatMessage)
+}
+
+// BotCommand is a slash command, such as "/roll 2d6", answered by a bot.
+type BotCommand struct {
+	// Name is the command without the slash.
+	Name string
+	// Usage is the usage line shown by clients, such as "/roll [NdM]".
+	Usage string
+	Help  string
+	// Run is called, after the message was delivered, for messages whose
+	// text starts with the command. args is the rest of the line.
+	Run func(msg message.ChatMessage, args string)
+}
+
+// BotHost is how a bot talks to the chat. The hub implements it for the bots
+// added with AddBot; tests can pass bots a fake instead.
+type BotHost interface {
+	// Post sends text to destination, a channel or a user, as the bot. It
+	// must not be called from Start.
+	Post(destination string, text string)
+	// Join makes the bot a member of channel, creating it if needed, so it
+	// is there for the bot to post in. It may only be called from Start.
+	Join(channel string)
+}
+
+// ReplyDestination returns where an answer to msg should be posted: the
+// channel it was sent to, or its author for a direct message.
+func ReplyDestination(msg message.ChatMessage) string {
+	if message.IsChannel(msg.Destination) {
+		return msg.Destination
+	}
+	return msg.Username
+}
+
+// botInboxSize is how many messages may wait for a bot before new ones are
+// dropped.
+const botInboxSize = 64
+
+// botRunner feeds a bot the messages delivered by the hub.
+type botRunner struct {
+	bot      Bot
+	commands map[string]BotCommand
+	inbox    chan message.ChatMessage
+}
+
+func (r *botRunner) run() {
+	for msg := range r.inbox {
+		r.bot.Observe(msg)
+
+		if !strings.HasPrefix(msg.Message, "/") || msg.Deleted {
+			continue
+		}
+		name, args, _ := strings.Cut(strings.TrimPrefix(msg.Message, "/"), " ")
+		if cmd, ok := r.commands[name]; ok && cmd.Run != nil {
+			cmd.Run(msg, strings.TrimSpace(args))
+		}
+	}
+}
+
+// hubBotHost is the BotHost the hub gives to a bot.
+type hubBotHost struct {
+	hub  *Hub
+	name string
+}
+
+func (h hubBotHost) Post(destination string, text string) {
+	submit(h.hub.metrics, "broadcast", h.hub.broadcast, chatRequest{msg: message.ChatMessage{
+		ID:          newMessageID(),
+		Username:    h.name,
+		Destination: destination,
+		Message:     text,
+		Timestamp:   time.Now().UTC(),
+	}})
+}
+
+func (h hubBotHost) Join(channel string) {
+	if channel == message.LobbyChannel {
+		return
+	}
+	if _, ok := h.hub.channels[channel]; !ok {
+		h.hub.channels[channel] = make(map[string]bool)
+	}
+	h.hub.channels[channel][h.name] = true
+}
+
+// AddBot registers bot and starts it. It must be called before Run, and
+// panics if two bots share a name.
+func (hub *Hub) AddBot(bot Bot) {
+	name := bot.Name()
+	if _, ok := hub.bots[name]; ok {
+		panic(fmt.Sprintf("server: bot %q added twice", name))
+	}
+
+	runner := &botRunner{
+		bot:      bot,
+		commands: make(map[string]BotCommand),
+		inbox:    make(chan message.ChatMessage, botInboxSize),
+	}
+	for _, cmd := range bot.Commands() {
+		runner.commands[cmd.Name] = cmd
+	}
+	hub.bots[name] = runner
+
+	bot.Start(hubBotHost{hub: hub, name: name})
+	go runner.run()
+}
+
+// isBot reports whether username belongs to a bot. The set of bots does not
+// change once the hub runs, so it is safe to call from any goroutine.
+func (hub *Hub) isBot(username string) bool {
+	_, ok := hub.bots[username]
+	return ok
+}
+
+// BotCommands describes the commands of every bot, for the hello sent to
+// clients.
+func (hub *Hub) BotCommands() []message.CommandInfo {
+	var infos []message.CommandInfo
+	for _, runner := range hub.bots {
+		for _, cmd := range runner.bot.Commands() {
+			infos = append(infos, message.CommandInfo{Name: cmd.Name, Usage: cmd.Usage, Help: cmd.Help})
+		}
+	}
+	slices.SortFunc(infos, func(a, b message.CommandInfo) int { return strings.Compare(a.Name, b.Name) })
+	return infos
+}
+
+// notifyBots hands msg to every bot but its author, without ever blocking
+// the hub.
+func (hub *Hub) notifyBots(msg message.ChatMessage) {
+	for name, runner := range hub.bots {
+		if name == msg.Username {
+			continue
+		}
+		select {
+		case runner.inbox <- msg:
+		default:
+			hub.log.Warn("bot is falling behind, dropping message", "bot", name, "id", msg.ID)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"slices"
+	"strings"
+
+	message "chatui/internal/protocol"
+)
+
+type channelOp struct {
+	client    *ConnectedClient
+	requestID string
+	kind      message.MessageType
+	channel   string
+}
+
+func validChannelName(name string) bool {
+	if !strings.HasPrefix(name, message.ChannelPrefix) {
+		return false
+	}
+	if len(name) < 2 || len(name) > 32 {
+		return false
+	}
+	return !strings.ContainsAny(name, " \t\r\n")
+}
+
+func (hub *Hub) handleChannelOp(op channelOp) {
+	username := op.client.Username
+
+	respond := func(success bool, msg string) {
+		resp := message.MakeReply(op.requestID, message.TypeChannelResponse, message.ChannelResponse{
+			Channel: op.channel,
+			Success: success,
+			Message: msg,
+		})
+		hub.send(op.client, resp)
+	}
+
+	switch op.kind {
+	case message.TypeChannelList:
+		hub.sendChannelList(op.client)
+		return
+	case message.TypeChannelCreate:
+		if !validChannelName(op.channel) {
+			respond(false, "Channel names must start with # and be at most 32 characters without spaces")
+			return
+		}
+		if _, ok := hub.channels[op.channel]; ok {
+			respond(false, "Channel already exists")
+			return
+		}
+		hub.channels[op.channel] = map[string]bool{username: true}
+		respond(true, "Channel created")
+	case message.TypeChannelJoin:
+		members, ok := hub.channels[op.channel]
+		if !ok {
+			respond(false, "Channel does not exist")
+			return
+		}
+		if members[username] {
+			respond(false, "Already a member of this channel")
+			return
+		}
+		members[username] = true
+		respond(true, "Joined channel")
+		hub.replayChannel(op.client, op.channel)
+	case message.TypeChannelLeave:
+		if op.channel == message.LobbyChannel {
+			respond(false, "Cannot leave "+message.LobbyChannel)
+			return
+		}
+		members, ok := hub.channels[op.channel]
+		if !ok || !members[username] {
+			respond(false, "Not a member of this channel")
+			return
+		}
+		delete(members, username)
+		if len(members) == 0 {
+			delete(hub.channels, op.channel)
+		}
+		respond(true, "Left channel")
+	default:
+		return
+	}
+
+	hub.broadcastChannelList()
+}
+
+// isMember reports whether username may read and write to channel.
+func (hub *Hub) isMember(channel string, username string) bool {
+	if channel == message.LobbyChannel {
+		return true
+	}
+	return hub.channels[channel][username]
+}
+
+func (hub *Hub) replayChannel(client *ConnectedClient, channel string) {
+	msgs, err := hub.history.Recent(historyReplayLimit, func(msg message.ChatMessage) bool {
+		return msg.Destination == channel
+	})
+	if err != nil || len(msgs) == 0 {
+		return
+	}
+
+	envelope := message.MakeEnvelope(message.TypeHistory, message.History{Messages: msgs})
+	hub.send(client, envelope)
+}
+
+func (hub *Hub) channelList(username string) message.ChannelList {
+	names := make([]string, 0, len(hub.channels))
+	for name := range hub.channels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	list := message.ChannelList{
+		Channels: make([]message.ChannelInfo, 0, len(names)+1),
+	}
+
+	lobby := message.ChannelInfo{Name: message.LobbyChannel, Joined: true}
+	for client := range hub.clients {
+		lobby.Members = append(lobby.Members, client.Username)
+	}
+	slices.Sort(lobby.Members)
+	list.Channels = append(list.Channels, lobby)
+
+	for _, name := range names {
+		info := message.ChannelInfo{Name: name}
+		for member := range hub.channels[name] {
+			info.Members = append(info.Members, member)
+		}
+		slices.Sort(info.Members)
+		info.Joined = hub.channels[name][username]
+		list.Channels = append(list.Channels, info)
+	}
+
+	return list
+}
+
+func (hub *Hub) sendChannelList(client *ConnectedClient) {
+	envelope := message.MakeEnvelope(message.TypeChannelList, hub.channelList(client.Username))
+	hub.send(client, envelope)
+}
+
+func (hub *Hub) broadcastChannelList() {
+	for client := range hub.clients {
+		hub.sendChannelList(client)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	message "chatui/internal/protocol"
+)
+
+// editOp asks the hub to change the text of, or with kind TypeMessageDelete
+// remove, a message already sent.
+type editOp struct {
+	client    *ConnectedClient
+	requestID string
+	kind      message.MessageType
+	id        string
+	text      string
+}
+
+func (hub *Hub) handleEditOp(op editOp) {
+	msg, ok := hub.history.Get(op.id)
+	if !ok || msg.Deleted {
+		hub.sendError(op.client, op.requestID, message.ErrorUnknownMessage, "Message not found")
+		return
+	}
+	// Moderators may remove what others said, only admins may rewrite it.
+	required := message.RoleAdmin
+	if op.kind == message.TypeMessageDelete {
+		required = message.RoleModerator
+	}
+	if msg.Username != op.client.Username && !op.client.Role.AtLeast(required) {
+		hub.sendError(op.client, op.requestID, message.ErrorForbidden, "Only the author can change this message")
+		return
+	}
+	// Muted users may still take back what they said, but not rewrite it.
+	if reason, muted := hub.mutedReason(op.client.Username); muted && op.kind == message.TypeMessageEdit {
+		hub.sendError(op.client, op.requestID, message.ErrorMuted, reason)
+		return
+	}
+
+	var envelope message.Envelope
+	if op.kind == message.TypeMessageDelete {
+		msg.Message = ""
+		msg.Deleted = true
+		envelope = message.MakeEnvelope(op.kind, message.MessageDelete{
+			ID:          msg.ID,
+			Username:    msg.Username,
+			Destination: msg.Destination,
+		})
+	} else {
+		msg.Message = op.text
+		msg.Edited = true
+		envelope = message.MakeEnvelope(op.kind, message.MessageEdit{
+			ID:          msg.ID,
+			Username:    msg.Username,
+			Destination: msg.Destination,
+			Message:     msg.Message,
+		})
+	}
+
+	if err := hub.history.Update(msg); err != nil {
+		hub.log.Error("failed to record change in history", "id", msg.ID, "err", err)
+	}
+	hub.updateOffline(msg)
+
+	reply := envelope
+	reply.RequestID = op.requestID
+	hub.send(op.client, reply)
+	for _, client := range hub.audience(msg.Username, msg.Destination) {
+		if client != op.client {
+			hub.send(client, envelope)
+		}
+	}
+}
+
+// updateOffline applies an edit or deletion to a direct message still queued
+// for an offline user.
+func (hub *Hub) updateOffline(msg message.ChatMessage) {
+	if message.IsChannel(msg.Destination) {
+		return
+	}
+
+	queue := hub.pending[msg.Destination]
+	for i := range queue {
+		if queue[i].ID != msg.ID {
+			continue
+		}
+		if msg.Deleted {
+			hub.pending[msg.Destination] = append(queue[:i], queue[i+1:]...)
+		} else {
+			queue[i] = msg
+		}
+		return
+	}
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+
+	message "chatui/internal/protocol"
+)
+
+// HistoryStore records every chat message routed by the hub so that users
+// who log in later can be sent the conversation so far.
+type HistoryStore interface {
+	// Append records a message that has been delivered by the hub.
+	Append(msg message.ChatMessage) error
+	// Get returns the message with the given ID, if it is still stored.
+	Get(id string) (message.ChatMessage, bool)
+	// Update replaces the stored message with the same ID as msg, after it
+	// was edited or deleted.
+	Update(msg message.ChatMessage) error
+	// Recent returns, in the order they were appended, the last limit
+	// messages of every conversation for which visible returns true.
+	Recent(limit int, visible func(message.ChatMessage) bool) ([]message.ChatMessage, error)
+	// Since returns, oldest first, the messages with a Seq greater than seq
+	// for which visible returns true.
+	Since(seq uint64, visible func(message.ChatMessage) bool) ([]message.ChatMessage, error)
+	// Replies returns, oldest first, the stored replies to the message with
+	// the given ID.
+	Replies(parentID string) ([]message.ChatMessage, error)
+	// LastSeq returns the highest Seq recorded, so the hub can continue
+	// numbering after a restart.
+	LastSeq() uint64
+}
+
+// conversationKey identifies the conversation a message belongs to, so that
+// both directions of a direct message end up in the same bucket.
+func conversationKey(msg message.ChatMessage) string {
+	if message.IsChannel(msg.Destination) {
+		return msg.Destination
+	}
+	a, b := msg.Username, msg.Destination
+	if a > b {
+		a, b = b, a
+	}
+	return a + "\x00" + b
+}
+
+// MemoryHistory is a HistoryStore that only keeps messages in memory. It is
+// lost when the server stops and is mostly useful for tests and development.
+type MemoryHistory struct {
+	mu       sync.Mutex
+	messages []message.ChatMessage
+	max      int
+
+	// ids maps the ID of every message kept to its position counted from
+	// the first message ever appended; dropped messages come before
+	// messages[0].
+	ids     map[string]int
+	dropped int
+	// replies maps the ID of every message that started a thread to the IDs of
+	// its replies, oldest first.
+	replies map[string][]string
+}
+
+// CreateMemoryHistory returns an empty in-memory store. If max is greater
+// than zero, only the newest max messages are retained.
+func CreateMemoryHistory(max int) *MemoryHistory {
+	return &MemoryHistory{max: max, ids: make(map[string]int), replies: make(map[string][]string)}
+}
+
+func (h *MemoryHistory) Append(msg message.ChatMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if msg.ID != "" {
+		h.ids[msg.ID] = h.dropped + len(h.messages)
+	}
+	if msg.ParentID != "" {
+		h.replies[msg.ParentID] = append(h.replies[msg.ParentID], msg.ID)
+	}
+	h.messages = append(h.messages, msg)
+	h.trim()
+	return nil
+}
+
+// trim drops the oldest messages beyond max.
+func (h *MemoryHistory) trim() {
+	if h.max <= 0 || len(h.messages) <= h.max {
+		return
+	}
+	n := len(h.messages) - h.max
+	for _, msg := range h.messages[:n] {
+		delete(h.ids, msg.ID)
+		// Replies come after their parent, so they go with it.
+		delete(h.replies, msg.ID)
+	}
+	// Appending copies the slice once its capacity runs out, so reslicing
+	// frees the dropped messages without copying on every append.
+	clear(h.messages[:n])
+	h.messages = h.messages[n:]
+	h.dropped += n
+}
+
+// all returns a copy of every message kept, oldest first.
+func (h *MemoryHistory) all() []message.ChatMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return slices.Clone(h.messages)
+}
+
+func (h *MemoryHistory) Get(id string) (message.ChatMessage, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i := h.index(id); i >= 0 {
+		return h.messages[i], true
+	}
+	return message.ChatMessage{}, false
+}
+
+func (h *MemoryHistory) Update(msg message.ChatMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i := h.index(msg.ID); i >= 0 {
+		h.messages[i] = msg
+	}
+	return nil
+}
+
+// index returns the position in h.messages of the message with the given ID,
+// or -1.
+func (h *MemoryHistory) index(id string) int {
+	if i, ok := h.ids[id]; ok {
+		return i - h.dropped
+	}
+	return -1
+}
+
+func (h *MemoryHistory) Recent(limit int, visible func(message.ChatMessage) bool) ([]message.ChatMessage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make(map[string]int)
+	var picked []message.ChatMessage
+	for i := len(h.messages) - 1; i >= 0; i-- {
+		msg := h.messages[i]
+		if !visible(msg) {
+			continue
+		}
+		key := conversationKey(msg)
+		if counts[key] >= limit {
+			continue
+		}
+		counts[key]++
+		picked = append(picked, msg)
+	}
+
+	for i, j := 0, len(picked)-1; i < j; i, j = i+1, j-1 {
+		picked[i], picked[j] = picked[j], picked[i]
+	}
+	return picked, nil
+}
+
+func (h *MemoryHistory) Since(seq uint64, visible func(message.ChatMessage) bool) ([]message.ChatMessage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var picked []message.ChatMessage
+	for _, msg := range h.messages {
+		if msg.Seq > seq && visible(msg) {
+			picked = append(picked, msg)
+		}
+	}
+	return picked, nil
+}
+
+func (h *MemoryHistory) Replies(parentID string) ([]message.ChatMessage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var picked []message.ChatMessage
+	for _, id := range h.replies[parentID] {
+		if i := h.index(id); i >= 0 {
+			picked = append(picked, h.messages[i])
+		}
+	}
+	return picked, nil
+}
+
+func (h *MemoryHistory) LastSeq() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var last uint64
+	for _, msg := range h.messages {
+		last = max(last, msg.Seq)
+	}
+	return last
+}
+
+// FileHistory is a HistoryStore backed by an append-only file containing one
+// JSON encoded message per line. Edits and deletions are appended as a new
+// copy of the message, which replaces the earlier one when loading. The file
+// is read once when the store is opened and kept in memory afterwards, and
+// rewritten with only the messages kept whenever it has grown to twice that.
+type FileHistory struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	lines  int
+	memory *MemoryHistory
+}
+
+// OpenFileHistory opens, or creates, the history file at path and loads the
+// newest max messages it contains, or all of them if max is zero.
+// Lines that cannot be decoded are logged and left out.
+func OpenFileHistory(path string, max int, logger *slog.Logger) (*FileHistory, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Updates may refer to any earlier message, so the whole file is read
+	// before the oldest messages are dropped.
+	memory := CreateMemoryHistory(0)
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+		var msg message.ChatMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			logger.Warn("dropping malformed history line", "path", path, "line", lines, "err", err)
+			continue
+		}
+		if i := memory.index(msg.ID); i >= 0 {
+			memory.messages[i] = msg
+			continue
+		}
+		memory.Append(msg)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	memory.max = max
+	memory.trim()
+
+	h := &FileHistory{path: path, memory: memory}
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// compact rewrites the file with one line per message kept in memory, and
+// reopens it for appending. It must be called with h.mu held, or before h is
+// shared.
+func (h *FileHistory) compact() error {
+	msgs := h.memory.all()
+
+	tmp := h.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file, err = os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	h.lines = len(msgs)
+	return err
+}
+
+func (h *FileHistory) Append(msg message.ChatMessage) error {
+	h.memory.Append(msg)
+	return h.write(msg)
+}
+
+func (h *FileHistory) Get(id string) (message.ChatMessage, bool) {
+	return h.memory.Get(id)
+}
+
+func (h *FileHistory) Update(msg message.ChatMessage) error {
+	h.memory.Update(msg)
+	return h.write(msg)
+}
+
+func (h *FileHistory) write(msg message.ChatMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := h.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	h.lines++
+	if keep := h.memory.max; keep > 0 && h.lines >= 2*keep {
+		return h.compact()
+	}
+	return nil
+}
+
+func (h *FileHistory) Recent(limit int, visible func(message.ChatMessage) bool) ([]message.ChatMessage, error) {
+	return h.memory.Recent(limit, visible)
+}
+
+func (h *FileHistory) Since(seq uint64, visible func(message.ChatMessage) bool) ([]message.ChatMessage, error) {
+	return h.memory.Since(seq, visible)
+}
+
+func (h *FileHistory) Replies(parentID string) ([]message.ChatMessage, error) {
+	return h.memory.Replies(parentID)
+}
+
+func (h *FileHistory) LastSeq() uint64 {
+	return h.memory.LastSeq()
+}
+
+// Close closes the underlying file.
+func (h *FileHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.file.Close()
+}
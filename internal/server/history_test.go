@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	message "chatui/internal/protocol"
+)
+
+func all(message.ChatMessage) bool { return true }
+
+func chat(seq uint64, from, to, text string) message.ChatMessage {
+	return message.ChatMessage{
+		ID:          "m" + strconv.FormatUint(seq, 10),
+		Seq:         seq,
+		Username:    from,
+		Destination: to,
+		Message:     text,
+	}
+}
+
+func ids(msgs []message.ChatMessage) []string {
+	var list []string
+	for _, msg := range msgs {
+		list = append(list, msg.ID)
+	}
+	return list
+}
+
+func TestMemoryHistoryAppendGetRecent(t *testing.T) {
+	h := CreateMemoryHistory(0)
+	h.Append(chat(1, "alice", "#go", "one"))
+	h.Append(chat(2, "bob", "alice", "two"))
+	h.Append(chat(3, "alice", "#go", "three"))
+	h.Append(chat(4, "alice", "bob", "four"))
+	h.Append(chat(5, "carol", "#go", "five"))
+
+	msg, ok := h.Get("m2")
+	if !ok || msg.Message != "two" {
+		t.Fatalf("Get(m2) = %+v, %v", msg, ok)
+	}
+	if _, ok := h.Get("missing"); ok {
+		t.Fatal("Get(missing) found a message")
+	}
+
+	// Both directions of a direct message are one conversation.
+	got, _ := h.Recent(2, all)
+	if want := []string{"m2", "m3", "m4", "m5"}; !slices.Equal(ids(got), want) {
+		t.Errorf("Recent(2) = %v, want %v", ids(got), want)
+	}
+
+	got, _ = h.Recent(10, func(msg message.ChatMessage) bool { return msg.Destination == "#go" })
+	if want := []string{"m1", "m3", "m5"}; !slices.Equal(ids(got), want) {
+		t.Errorf("Recent of #go = %v, want %v", ids(got), want)
+	}
+
+	got, _ = h.Since(3, all)
+	if want := []string{"m4", "m5"}; !slices.Equal(ids(got), want) {
+		t.Errorf("Since(3) = %v, want %v", ids(got), want)
+	}
+	if last := h.LastSeq(); last != 5 {
+		t.Errorf("LastSeq() = %d, want 5", last)
+	}
+}
+
+func TestMemoryHistoryUpdate(t *testing.T) {
+	h := CreateMemoryHistory(0)
+	h.Append(chat(1, "alice", "#go", "one"))
+
+	edited := chat(1, "alice", "#go", "uno")
+	edited.Edited = true
+	h.Update(edited)
+	// Messages no longer stored are not brought back.
+	h.Update(chat(9, "alice", "#go", "gone"))
+
+	got, _ := h.Recent(10, all)
+	if len(got) != 1 || got[0].Message != "uno" || !got[0].Edited {
+		t.Errorf("after Update, Recent = %+v", got)
+	}
+}
+
+func TestMemoryHistoryMax(t *testing.T) {
+	h := CreateMemoryHistory(3)
+	for seq := uint64(1); seq <= 5; seq++ {
+		h.Append(chat(seq, "alice", "#go", "hi"))
+	}
+
+	got, _ := h.Since(0, all)
+	if want := []string{"m3", "m4", "m5"}; !slices.Equal(ids(got), want) {
+		t.Errorf("kept %v, want %v", ids(got), want)
+	}
+	if _, ok := h.Get("m1"); ok {
+		t.Error("the oldest message was kept")
+	}
+	if last := h.LastSeq(); last != 5 {
+		t.Errorf("LastSeq() = %d, want 5", last)
+	}
+}
+
+func lineCount(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestFileHistoryReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	h, err := OpenFileHistory(path, 0, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Append(chat(1, "alice", "#go", "one"))
+	h.Append(chat(2, "bob", "#go", "two"))
+	h.Append(chat(3, "alice", "bob", "three"))
+
+	edited := chat(1, "alice", "#go", "uno")
+	edited.Edited = true
+	h.Update(edited)
+	deleted := chat(3, "alice", "bob", "")
+	deleted.Deleted = true
+	h.Update(deleted)
+	h.Close()
+
+	h, err = OpenFileHistory(path, 0, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	got, _ := h.Since(0, all)
+	if want := []string{"m1", "m2", "m3"}; !slices.Equal(ids(got), want) {
+		t.Fatalf("reopened history has %v, want %v", ids(got), want)
+	}
+	if got[0].Message != "uno" || !got[0].Edited {
+		t.Errorf("edit was not replayed: %+v", got[0])
+	}
+	if !got[2].Deleted {
+		t.Errorf("deletion was not replayed: %+v", got[2])
+	}
+	if last := h.LastSeq(); last != 3 {
+		t.Errorf("LastSeq() = %d, want 3", last)
+	}
+
+	// Reopening dropped the superseded copies.
+	if n := lineCount(t, path); n != 3 {
+		t.Errorf("file has %d lines after reopening, want 3", n)
+	}
+}
+
+func TestFileHistoryMax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	h, err := OpenFileHistory(path, 0, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint64(1); seq <= 10; seq++ {
+		h.Append(chat(seq, "alice", "#go", "hi"))
+	}
+	h.Close()
+
+	h, err = OpenFileHistory(path, 4, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	got, _ := h.Since(0, all)
+	if want := []string{"m7", "m8", "m9", "m10"}; !slices.Equal(ids(got), want) {
+		t.Fatalf("reopened history has %v, want %v", ids(got), want)
+	}
+	if n := lineCount(t, path); n != 4 {
+		t.Errorf("file has %d lines after reopening, want 4", n)
+	}
+
+	// The file is compacted again once it has twice as many lines as kept.
+	for seq := uint64(11); seq <= 13; seq++ {
+		h.Append(chat(seq, "alice", "#go", "hi"))
+	}
+	edited := chat(13, "alice", "#go", "edited")
+	h.Update(edited)
+	if n := lineCount(t, path); n != 4 {
+		t.Errorf("file has %d lines after growing, want 4", n)
+	}
+	h.Append(chat(14, "alice", "#go", "hi"))
+	if n := lineCount(t, path); n != 5 {
+		t.Errorf("file has %d lines after appending, want 5", n)
+	}
+
+	msg, ok := h.Get("m13")
+	if !ok || msg.Message != "edited" {
+		t.Errorf("Get(m13) = %+v, %v", msg, ok)
+	}
+}
+
+func TestFileHistoryMalformedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	data := `{"id":"m1","seq":1,"username":"alice","destination":"#go","message":"one"}` + "\n" +
+		`{"id":"m2","seq":` + "\n" +
+		`{"id":"m3","seq":3,"username":"bob","destination":"#go","message":"three"}` + "\n" +
+		`{"id":"m1","seq":1,"username":"alice","destination":"#go","message":"uno","edited":true}` + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	h, err := OpenFileHistory(path, 0, slog.New(slog.NewTextHandler(&logged, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	got, _ := h.Since(0, all)
+	if want := []string{"m1", "m3"}; !slices.Equal(ids(got), want) {
+		t.Fatalf("loaded %v, want %v", ids(got), want)
+	}
+	if got[0].Message != "uno" {
+		t.Errorf("edit was not replayed: %+v", got[0])
+	}
+	if !strings.Contains(logged.String(), "line=2") || !strings.Contains(logged.String(), path) {
+		t.Errorf("the malformed line was not logged with its place:\n%s", logged.String())
+	}
+}
+
+func TestMemoryHistoryReplies(t *testing.T) {
+	h := CreateMemoryHistory(4)
+	reply := func(seq uint64, parent string) message.ChatMessage {
+		msg := chat(seq, "alice", "#go", "re")
+		msg.ParentID = parent
+		return msg
+	}
+	h.Append(chat(1, "alice", "#go", "parent"))
+	h.Append(reply(2, "m1"))
+	h.Append(chat(3, "bob", "#go", "other"))
+	h.Append(reply(4, "m1"))
+
+	got, _ := h.Replies("m1")
+	if want := []string{"m2", "m4"}; !slices.Equal(ids(got), want) {
+		t.Errorf("Replies(m1) = %v, want %v", ids(got), want)
+	}
+
+	// A thread is forgotten with the message that started it.
+	h.Append(reply(5, "m3"))
+	if got, _ := h.Replies("m1"); len(got) != 0 || len(h.replies) != 1 {
+		t.Errorf("Replies(m1) = %v after it was dropped", ids(got))
+	}
+	got, _ = h.Replies("m3")
+	if want := []string{"m5"}; !slices.Equal(ids(got), want) {
+		t.Errorf("Replies(m3) = %v, want %v", ids(got), want)
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newHub returns a hub with an in-memory history, not running yet.
+func newHub() *Hub {
+	hub := CreateHub(CreateMemoryHistory(0), DefaultQueueOptions, DefaultOfflineOptions)
+	hub.SetLogger(discard)
+	return hub
+}
+
+// startHub runs a hub with the given bots. The hub goroutine is left running
+// when the test ends.
+func startHub(t *testing.T, bots ...Bot) *Hub {
+	t.Helper()
+	hub := newHub()
+	for _, bot := range bots {
+		hub.AddBot(bot)
+	}
+	go hub.Run()
+	return hub
+}
+
+// connect registers a client logged in as username that supports every
+// capability. Its queue is read by the test instead of a socket writer.
+func connect(t *testing.T, hub *Hub, username string) *ConnectedClient {
+	t.Helper()
+	client := &ConnectedClient{
+		Username:     username,
+		Role:         hub.moderation.Role(username),
+		capabilities: message.Capabilities,
+		send:         make(chan outbound, 64),
+		log:          discard,
+	}
+	hub.register <- client
+	return client
+}
+
+// expect returns the data of the next envelope of type t queued for client,
+// skipping the others.
+func expect[T any](t *testing.T, client *ConnectedClient, typ message.MessageType) T {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case out, ok := <-client.send:
+			if !ok {
+				t.Fatalf("%s was disconnected waiting for %s", client.Username, typ)
+			}
+			if out.envelope.Type != typ {
+				continue
+			}
+			var data T
+			if err := json.Unmarshal(out.envelope.Data, &data); err != nil {
+				t.Fatal(err)
+			}
+			return data
+		case <-timeout:
+			t.Fatalf("%s was sent no %s", client.Username, typ)
+		}
+	}
+}
+
+// say has client send text to destination, the way ServeHTTP does.
+func say(hub *Hub, client *ConnectedClient, destination string, text string) {
+	hub.broadcast <- chatRequest{client: client, requestID: "r", msg: message.ChatMessage{
+		ID:          newMessageID(),
+		Username:    client.Username,
+		Destination: destination,
+		Message:     text,
+		Timestamp:   time.Now().UTC(),
+	}}
+}
+
+// echoBot answers /echo with its arguments and reports what it observed. It
+// joins channel when started, if set.
+type echoBot struct {
+	host     BotHost
+	channel  string
+	observed chan message.ChatMessage
+}
+
+func newEchoBot() *echoBot {
+	return &echoBot{observed: make(chan message.ChatMessage, 16)}
+}
+
+func (b *echoBot) Name() string { return "echo" }
+
+func (b *echoBot) Commands() []BotCommand {
+	return []BotCommand{{
+		Name:  "echo",
+		Usage: "/echo <text>",
+		Help:  "repeat text",
+		Run: func(msg message.ChatMessage, args string) {
+			b.host.Post(ReplyDestination(msg), "echo: "+args)
+		},
+	}}
+}
+
+func (b *echoBot) Start(host BotHost) {
+	b.host = host
+	if b.channel != "" {
+		host.Join(b.channel)
+	}
+}
+
+func (b *echoBot) Observe(msg message.ChatMessage) { b.observed <- msg }
+
+func TestBotInUserList(t *testing.T) {
+	hub := startHub(t, newEchoBot())
+	alice := connect(t, hub, "alice")
+
+	list := expect[message.UserListUpdate](t, alice, message.TypeUserListUpdate)
+	users := map[string]bool{}
+	for _, user := range list.Users {
+		users[user] = true
+	}
+	if !users["alice"] || !users["echo"] || len(list.Users) != 2 {
+		t.Errorf("user list is %v, want alice and echo", list.Users)
+	}
+
+	if cmds := hub.BotCommands(); len(cmds) != 1 || cmds[0].Name != "echo" || cmds[0].Usage != "/echo <text>" {
+		t.Errorf("BotCommands() = %+v", cmds)
+	}
+}
+
+func TestBotCommandInChannel(t *testing.T) {
+	bot := newEchoBot()
+	hub := startHub(t, bot)
+	alice := connect(t, hub, "alice")
+	bob := connect(t, hub, "bob")
+
+	say(hub, alice, message.LobbyChannel, "/echo hello there")
+
+	for _, client := range []*ConnectedClient{alice, bob} {
+		expect[message.ChatMessage](t, client, message.TypeChatMessage)
+		reply := expect[message.ChatMessage](t, client, message.TypeChatMessage)
+		if reply.Username != "echo" || reply.Destination != message.LobbyChannel || reply.Message != "echo: hello there" {
+			t.Errorf("%s got %+v, want the answer of echo in %s", client.Username, reply, message.LobbyChannel)
+		}
+	}
+
+	// The bot observes the command but not its own answer.
+	if msg := <-bot.observed; msg.Message != "/echo hello there" {
+		t.Errorf("bot observed %q first", msg.Message)
+	}
+	select {
+	case msg := <-bot.observed:
+		t.Errorf("bot observed %q", msg.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBotCommandDirect(t *testing.T) {
+	hub := startHub(t, newEchoBot())
+	alice := connect(t, hub, "alice")
+	bob := connect(t, hub, "bob")
+
+	say(hub, alice, "echo", "/echo psst")
+
+	sent := expect[message.ChatMessage](t, alice, message.TypeChatMessage)
+	if sent.Destination != "echo" {
+		t.Fatalf("alice got %+v, want the message to echo", sent)
+	}
+	reply := expect[message.ChatMessage](t, alice, message.TypeChatMessage)
+	if reply.Username != "echo" || reply.Destination != "alice" || reply.Message != "echo: psst" {
+		t.Errorf("alice got %+v, want the answer of echo", reply)
+	}
+
+	// Nobody else sees a direct conversation with a bot.
+	say(hub, bob, message.LobbyChannel, "hi")
+	if msg := expect[message.ChatMessage](t, bob, message.TypeChatMessage); msg.Username != "bob" {
+		t.Errorf("bob got %+v", msg)
+	}
+}
+
+func TestBotUsernameReserved(t *testing.T) {
+	hub := startHub(t, newEchoBot())
+	if !hub.isBot("echo") || hub.isBot("alice") {
+		t.Error("isBot does not match the bots added")
+	}
+}
+
+func TestThreadRequest(t *testing.T) {
+	hub := startHub(t)
+	alice := connect(t, hub, "alice")
+
+	say(hub, alice, message.LobbyChannel, "parent")
+	parent := expect[message.ChatMessage](t, alice, message.TypeChatMessage)
+	for _, text := range []string{"first", "second"} {
+		hub.broadcast <- chatRequest{client: alice, requestID: "r", msg: message.ChatMessage{
+			ID:          newMessageID(),
+			Username:    "alice",
+			Destination: message.LobbyChannel,
+			Message:     text,
+			ParentID:    parent.ID,
+			Timestamp:   time.Now().UTC(),
+		}}
+		expect[message.ChatMessage](t, alice, message.TypeChatMessage)
+	}
+	say(hub, alice, message.LobbyChannel, "unrelated")
+
+	hub.threads <- threadRequest{client: alice, requestID: "t", parentID: parent.ID}
+	thread := expect[message.Thread](t, alice, message.TypeThread)
+	if thread.Parent.ID != parent.ID || thread.Parent.Replies != 2 {
+		t.Errorf("parent is %+v", thread.Parent)
+	}
+	if len(thread.Replies) != 2 || thread.Replies[0].Message != "first" || thread.Replies[1].Message != "second" {
+		t.Errorf("replies are %+v, want first and second", thread.Replies)
+	}
+}
+
+func TestBotJoinsChannel(t *testing.T) {
+	bot := newEchoBot()
+	bot.channel = "#ops"
+	hub := startHub(t, bot)
+	alice := connect(t, hub, "alice")
+
+	hub.channelOps <- channelOp{client: alice, requestID: "j", kind: message.TypeChannelJoin, channel: "#ops"}
+	if resp := expect[message.ChannelResponse](t, alice, message.TypeChannelResponse); !resp.Success {
+		t.Fatalf("joining the channel of the bot failed: %s", resp.Message)
+	}
+
+	// The channel stays when its last user leaves.
+	hub.channelOps <- channelOp{client: alice, requestID: "l", kind: message.TypeChannelLeave, channel: "#ops"}
+	expect[message.ChannelResponse](t, alice, message.TypeChannelResponse)
+	bot.host.Post("#ops", "still here")
+	settle(t, hub)
+	if msgs, _ := hub.history.Since(0, all); len(msgs) != 1 || msgs[0].Destination != "#ops" {
+		t.Errorf("history is %+v, want the post of the bot in #ops", msgs)
+	}
+}
+
+func TestBotRejectedPostLogged(t *testing.T) {
+	var logged bytes.Buffer
+	bot := newEchoBot()
+	hub := newHub()
+	hub.SetLogger(slog.New(slog.NewTextHandler(&logged, nil)))
+	hub.AddBot(bot)
+	go hub.Run()
+
+	bot.host.Post("#nowhere", "hello?")
+	settle(t, hub)
+	if !strings.Contains(logged.String(), "dropping bot message") || !strings.Contains(logged.String(), "#nowhere") {
+		t.Errorf("the rejected post was not logged:\n%s", logged.String())
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeLatencyBuckets are the upper bounds, in seconds, of the write latency
+// histograms.
+var writeLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range writeLatencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics counts what the hub and its connections do, for the /metrics
+// endpoint. It is safe to use from any goroutine.
+type Metrics struct {
+	connected atomic.Int64
+
+	mu            sync.Mutex
+	messages      map[string]uint64
+	loginFailures map[loginCause]uint64
+	// waiting counts, per hub channel, the goroutines blocked handing a
+	// request to the hub.
+	waiting map[string]int64
+	// queues are the send queues of connected clients.
+	queues       map[*ConnectedClient]chan outbound
+	writeLatency map[string]*histogram
+}
+
+func createMetrics() *Metrics {
+	return &Metrics{
+		messages:      make(map[string]uint64),
+		loginFailures: make(map[loginCause]uint64),
+		waiting:       make(map[string]int64),
+		queues:        make(map[*ConnectedClient]chan outbound),
+		writeLatency:  make(map[string]*histogram),
+	}
+}
+
+// Metrics returns the metrics of the hub.
+func (hub *Hub) Metrics() *Metrics {
+	return hub.metrics
+}
+
+// messageDelivered counts a chat message, by whether it went to a channel
+// or was a direct message.
+func (m *Metrics) messageDelivered(channel bool) {
+	kind := "direct"
+	if channel {
+		kind = "broadcast"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[kind]++
+}
+
+func (m *Metrics) loginFailed(cause loginCause) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loginFailures[cause]++
+}
+
+func (m *Metrics) addWaiting(channel string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiting[channel] += delta
+}
+
+// submit hands v to the hub on ch, counting the time spent waiting as
+// backlog of the named channel.
+func submit[T any](m *Metrics, channel string, ch chan<- T, v T) {
+	m.addWaiting(channel, 1)
+	defer m.addWaiting(channel, -1)
+	ch <- v
+}
+
+func (m *Metrics) clientConnected(client *ConnectedClient) {
+	m.connected.Add(1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queues[client] = client.send
+	if _, ok := m.writeLatency[client.Username]; !ok {
+		m.writeLatency[client.Username] = &histogram{counts: make([]uint64, len(writeLatencyBuckets))}
+	}
+}
+
+// clientDisconnected forgets client, and the write latencies of its user if
+// it was their last connection.
+func (m *Metrics) clientDisconnected(client *ConnectedClient, lastOfUser bool) {
+	m.connected.Add(-1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.queues, client)
+	if lastOfUser {
+		delete(m.writeLatency, client.Username)
+	}
+}
+
+func (m *Metrics) observeWrite(username string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.writeLatency[username]; ok {
+		h.observe(d.Seconds())
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	writeHeader(&b, "chatui_connected_clients", "gauge", "Clients currently connected and logged in.")
+	fmt.Fprintf(&b, "chatui_connected_clients %d\n", m.connected.Load())
+
+	m.mu.Lock()
+
+	writeHeader(&b, "chatui_messages_total", "counter", "Chat messages delivered, by kind: broadcast to a channel or direct.")
+	for _, kind := range []string{"broadcast", "direct"} {
+		fmt.Fprintf(&b, "chatui_messages_total{kind=%s} %d\n", quote(kind), m.messages[kind])
+	}
+
+	writeHeader(&b, "chatui_login_failures_total", "counter", "Failed login attempts, by reason.")
+	for _, cause := range slices.Sorted(maps.Keys(m.loginFailures)) {
+		fmt.Fprintf(&b, "chatui_login_failures_total{reason=%s} %d\n", quote(string(cause)), m.loginFailures[cause])
+	}
+
+	writeHeader(&b, "chatui_hub_backlog", "gauge", "Requests waiting to be taken by the hub, by hub channel.")
+	for _, channel := range slices.Sorted(maps.Keys(m.waiting)) {
+		fmt.Fprintf(&b, "chatui_hub_backlog{channel=%s} %d\n", quote(channel), m.waiting[channel])
+	}
+
+	queued := 0
+	for _, queue := range m.queues {
+		queued += len(queue)
+	}
+	writeHeader(&b, "chatui_send_queue_envelopes", "gauge", "Envelopes waiting in the send queues of all clients.")
+	fmt.Fprintf(&b, "chatui_send_queue_envelopes %d\n", queued)
+
+	writeHeader(&b, "chatui_client_write_seconds", "histogram", "Time taken to write an envelope to a client's socket, by user.")
+	for _, user := range slices.Sorted(maps.Keys(m.writeLatency)) {
+		h := m.writeLatency[user]
+		for i, bound := range writeLatencyBuckets {
+			fmt.Fprintf(&b, "chatui_client_write_seconds_bucket{user=%s,le=%s} %d\n", quote(user), quote(strconv.FormatFloat(bound, 'g', -1, 64)), h.counts[i])
+		}
+		fmt.Fprintf(&b, "chatui_client_write_seconds_bucket{user=%s,le=\"+Inf\"} %d\n", quote(user), h.count)
+		fmt.Fprintf(&b, "chatui_client_write_seconds_sum{user=%s} %g\n", quote(user), h.sum)
+		fmt.Fprintf(&b, "chatui_client_write_seconds_count{user=%s} %d\n", quote(user), h.count)
+	}
+
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quote quotes a label value, escaping what the exposition format requires.
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// Ready reports whether the hub answers within the deadline of ctx, that is
+// whether it is running and not stuck.
+func (hub *Hub) Ready(ctx context.Context) bool {
+	reply := make(chan struct{}, 1)
+	select {
+	case hub.pings <- reply:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case <-reply:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+
+	"github.com/coder/websocket"
+)
+
+// dialConn returns the client end of a websocket connection to a server that
+// only waits for it to close.
+func dialConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.Read(context.Background())
+		c.CloseNow()
+	}))
+	t.Cleanup(srv.Close)
+
+	c, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.CloseNow() })
+	return c
+}
+
+// dialServer connects a websocket to cs, not logged in yet.
+func dialServer(t *testing.T, cs *ChatServer) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(cs)
+	t.Cleanup(srv.Close)
+
+	c, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.CloseNow() })
+	return c
+}
+
+// settle waits until the hub handled everything submitted before.
+func settle(t *testing.T, hub *Hub) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !hub.Ready(ctx) {
+		t.Fatal("the hub is not answering")
+	}
+}
+
+func metricsText(hub *Hub) string {
+	var b strings.Builder
+	hub.Metrics().WriteTo(&b)
+	return b.String()
+}
+
+func TestMetricsSessionReplaced(t *testing.T) {
+	hub := startHub(t)
+
+	old := &ConnectedClient{
+		Conn:         dialConn(t),
+		Username:     "alice",
+		capabilities: message.Capabilities,
+		send:         make(chan outbound, 64),
+		log:          discard,
+	}
+	hub.register <- old
+	settle(t, hub)
+	hub.metrics.observeWrite("alice", time.Millisecond)
+	replacement := connect(t, hub, "alice")
+	settle(t, hub)
+
+	for range old.send {
+	}
+	if n := hub.metrics.connected.Load(); n != 1 {
+		t.Errorf("%d clients connected after a session was replaced, want 1", n)
+	}
+	if !strings.Contains(metricsText(hub), `chatui_client_write_seconds_count{user="alice"} 1`) {
+		t.Error("the write latencies of alice were forgotten when the session was replaced")
+	}
+
+	// The old session's reader unregisters it once its socket is closed.
+	hub.unregister <- old
+	settle(t, hub)
+	if n := hub.metrics.connected.Load(); n != 1 {
+		t.Errorf("%d clients connected after the old session went away, want 1", n)
+	}
+
+	hub.unregister <- replacement
+	settle(t, hub)
+	text := metricsText(hub)
+	if !strings.Contains(text, "chatui_connected_clients 0\n") {
+		t.Errorf("clients still counted after everyone left:\n%s", text)
+	}
+	if strings.Contains(text, `user="alice"`) {
+		t.Errorf("alice is still in the metrics:\n%s", text)
+	}
+	hub.metrics.mu.Lock()
+	queues := len(hub.metrics.queues)
+	hub.metrics.mu.Unlock()
+	if queues != 0 {
+		t.Errorf("%d send queues still counted", queues)
+	}
+}
@@ -0,0 +1,505 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	message "chatui/internal/protocol"
+
+	"github.com/coder/websocket"
+)
+
+// defaultMuteDuration applies to mutes requested without a duration.
+const defaultMuteDuration = 10 * time.Minute
+
+// Ban keeps a username or an IP address from logging in.
+type Ban struct {
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+	// Until is zero for permanent bans.
+	Until time.Time `json:"until,omitzero"`
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && !now.Before(b.Until)
+}
+
+// describe explains the ban to the user it keeps out.
+func (b Ban) describe() string {
+	text := "You are banned"
+	if !b.Until.IsZero() {
+		text += " until " + b.Until.Local().Format("2006-01-02 15:04")
+	}
+	if b.Reason != "" {
+		text += ": " + b.Reason
+	}
+	return text
+}
+
+type moderationData struct {
+	// Roles holds every user whose role is not message.RoleUser.
+	Roles map[string]message.Role `json:"roles"`
+	// Bans is keyed by username or IP address.
+	Bans map[string]Ban `json:"bans"`
+	// Mutes holds until when users muted by moderators stay muted.
+	Mutes map[string]time.Time `json:"mutes,omitempty"`
+}
+
+// ModerationStore keeps the roles of users and the bans and mutes in force,
+// written to a JSON file after each change. An empty path keeps the store in
+// memory only.
+type ModerationStore struct {
+	mu   sync.Mutex
+	path string
+	data moderationData
+}
+
+// OpenModerationStore loads the roles, bans and mutes stored at path,
+// creating the store if the file does not exist yet.
+func OpenModerationStore(path string) (*ModerationStore, error) {
+	ms := createModerationStore(path)
+	if path == "" {
+		return ms, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &ms.data); err != nil {
+		return nil, err
+	}
+	if ms.data.Roles == nil {
+		ms.data.Roles = make(map[string]message.Role)
+	}
+	if ms.data.Bans == nil {
+		ms.data.Bans = make(map[string]Ban)
+	}
+	if ms.data.Mutes == nil {
+		ms.data.Mutes = make(map[string]time.Time)
+	}
+	return ms, nil
+}
+
+func createModerationStore(path string) *ModerationStore {
+	return &ModerationStore{
+		path: path,
+		data: moderationData{
+			Roles: make(map[string]message.Role),
+			Bans:  make(map[string]Ban),
+			Mutes: make(map[string]time.Time),
+		},
+	}
+}
+
+// Role returns the role of username, message.RoleUser unless set otherwise.
+func (ms *ModerationStore) Role(username string) message.Role {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if role, ok := ms.data.Roles[username]; ok {
+		return role
+	}
+	return message.RoleUser
+}
+
+// SetRole gives username a role.
+func (ms *ModerationStore) SetRole(username string, role message.Role) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if role == message.RoleUser {
+		delete(ms.data.Roles, username)
+	} else {
+		ms.data.Roles[username] = role
+	}
+	return ms.save()
+}
+
+// Staff returns the users whose role is not message.RoleUser.
+func (ms *ModerationStore) Staff() map[string]message.Role {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return maps.Clone(ms.data.Roles)
+}
+
+// Ban bans target, a username or an IP address.
+func (ms *ModerationStore) Ban(target string, ban Ban) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.data.Bans[target] = ban
+	return ms.save()
+}
+
+// Unban lifts the ban on target, reporting whether there was one.
+func (ms *ModerationStore) Unban(target string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ban, ok := ms.data.Bans[target]
+	if !ok {
+		return false, nil
+	}
+	delete(ms.data.Bans, target)
+	return !ban.expired(time.Now()), ms.save()
+}
+
+// Banned returns the ban in force on username or ip, if any.
+func (ms *ModerationStore) Banned(username string, ip string) (Ban, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	for _, target := range []string{username, ip} {
+		if ban, ok := ms.data.Bans[target]; ok && target != "" && !ban.expired(now) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Mute keeps username from posting until until.
+func (ms *ModerationStore) Mute(username string, until time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	for user, end := range ms.data.Mutes {
+		if !now.Before(end) {
+			delete(ms.data.Mutes, user)
+		}
+	}
+	ms.data.Mutes[username] = until
+	return ms.save()
+}
+
+// Unmute lifts the mute on username, reporting whether there was one.
+func (ms *ModerationStore) Unmute(username string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	until, ok := ms.data.Mutes[username]
+	if !ok {
+		return false, nil
+	}
+	delete(ms.data.Mutes, username)
+	return time.Now().Before(until), ms.save()
+}
+
+// Muted returns until when username is muted, if they are.
+func (ms *ModerationStore) Muted(username string) (time.Time, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	until, ok := ms.data.Mutes[username]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// save writes the store to disk. The caller must hold ms.mu.
+func (ms *ModerationStore) save() error {
+	if ms.path == "" {
+		return nil
+	}
+	return writeJSONFile(ms.path, ms.data)
+}
+
+// AuditEntry records one moderation action.
+type AuditEntry struct {
+	Time     time.Time                `json:"time"`
+	Actor    string                   `json:"actor"`
+	Action   message.ModerationAction `json:"action"`
+	Target   string                   `json:"target"`
+	Duration string                   `json:"duration,omitempty"`
+	Reason   string                   `json:"reason,omitempty"`
+	Role     message.Role             `json:"role,omitempty"`
+}
+
+// AuditLog appends every moderation action, one JSON object per line, to a
+// file. A nil AuditLog records nothing.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenAuditLog opens, or creates, the audit log at path.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: f}, nil
+}
+
+// Record appends entry to the log.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the underlying file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+// moderationOp is a moderation request from a connected client.
+type moderationOp struct {
+	client    *ConnectedClient
+	requestID string
+	req       message.Moderation
+}
+
+// SetModeration sets where roles, bans and mutes are kept and where
+// moderation actions are logged; audit may be nil. It must be called before
+// Run.
+func (hub *Hub) SetModeration(store *ModerationStore, audit *AuditLog) {
+	hub.moderation = store
+	hub.audit = audit
+}
+
+// requiredRole returns the role needed to take action.
+func requiredRole(action message.ModerationAction) (message.Role, bool) {
+	switch action {
+	case message.ModerationKick, message.ModerationMute, message.ModerationUnmute:
+		return message.RoleModerator, true
+	case message.ModerationBan, message.ModerationUnban, message.ModerationRole:
+		return message.RoleAdmin, true
+	default:
+		return "", false
+	}
+}
+
+func (hub *Hub) handleModeration(op moderationOp) {
+	req, actor := op.req, op.client
+
+	required, ok := requiredRole(req.Action)
+	if !ok {
+		hub.sendError(actor, op.requestID, message.ErrorBadRequest, fmt.Sprintf("Unknown moderation action %q", req.Action))
+		return
+	}
+	if !actor.Role.AtLeast(required) {
+		hub.sendError(actor, op.requestID, message.ErrorForbidden, fmt.Sprintf("Only %ss can %s", required, req.Action))
+		return
+	}
+
+	isIP := net.ParseIP(req.Target) != nil
+	if isIP && req.Action != message.ModerationBan && req.Action != message.ModerationUnban {
+		hub.sendError(actor, op.requestID, message.ErrorBadRequest, "Only bans apply to IP addresses")
+		return
+	}
+	if !isIP && req.Action != message.ModerationUnban {
+		if req.Target == actor.Username || hub.moderation.Role(req.Target).AtLeast(actor.Role) {
+			hub.sendError(actor, op.requestID, message.ErrorForbidden, "You can only moderate users with a lower role than yours")
+			return
+		}
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			hub.sendError(actor, op.requestID, message.ErrorBadRequest, fmt.Sprintf("Invalid duration %q, expected something like 10m or 24h", req.Duration))
+			return
+		}
+		duration = d
+	}
+
+	because := ""
+	if req.Reason != "" {
+		because = ": " + req.Reason
+	}
+
+	var summary string
+	switch req.Action {
+	case message.ModerationKick:
+		clients := hub.clientsOf(req.Target, "")
+		if len(clients) == 0 {
+			hub.sendError(actor, op.requestID, message.ErrorUnknownDestination, req.Target+" is not online")
+			return
+		}
+		for _, client := range clients {
+			hub.disconnect(client, "You were kicked by "+actor.Username+because)
+		}
+		summary = actor.Username + " kicked " + req.Target
+	case message.ModerationMute:
+		if !hub.isOnline(req.Target) && !hub.isKnownUser(req.Target) {
+			hub.sendError(actor, op.requestID, message.ErrorUnknownDestination, "Unknown user "+req.Target)
+			return
+		}
+		if duration == 0 {
+			duration = defaultMuteDuration
+		}
+		if err := hub.moderation.Mute(req.Target, time.Now().Add(duration)); err != nil {
+			hub.log.Error("failed to save mute", "target", req.Target, "err", err)
+		}
+		hub.notify(req.Target, fmt.Sprintf("You were muted by %s for %v%s", actor.Username, duration, because))
+		summary = fmt.Sprintf("%s muted %s for %v", actor.Username, req.Target, duration)
+	case message.ModerationUnmute:
+		found, err := hub.moderation.Unmute(req.Target)
+		if err != nil {
+			hub.log.Error("failed to save unmute", "target", req.Target, "err", err)
+		}
+		if !found {
+			hub.sendError(actor, op.requestID, message.ErrorBadRequest, req.Target+" is not muted")
+			return
+		}
+		hub.notify(req.Target, "You were unmuted by "+actor.Username)
+		summary = actor.Username + " unmuted " + req.Target
+	case message.ModerationBan:
+		ban := Ban{By: actor.Username, Reason: req.Reason, Since: time.Now().UTC()}
+		if duration > 0 {
+			ban.Until = ban.Since.Add(duration)
+		}
+		if err := hub.moderation.Ban(req.Target, ban); err != nil {
+			hub.log.Error("failed to save ban", "target", req.Target, "err", err)
+		}
+		username, ip := req.Target, ""
+		if isIP {
+			username, ip = "", req.Target
+		}
+		for _, client := range hub.clientsOf(username, ip) {
+			if client != actor {
+				hub.disconnect(client, ban.describe())
+			}
+		}
+		summary = actor.Username + " banned " + req.Target
+		if duration > 0 {
+			summary += fmt.Sprintf(" for %v", duration)
+		}
+	case message.ModerationUnban:
+		found, err := hub.moderation.Unban(req.Target)
+		if err != nil {
+			hub.log.Error("failed to save unban", "target", req.Target, "err", err)
+		}
+		if !found {
+			hub.sendError(actor, op.requestID, message.ErrorBadRequest, req.Target+" is not banned")
+			return
+		}
+		summary = actor.Username + " unbanned " + req.Target
+	case message.ModerationRole:
+		if req.Role != message.RoleUser && req.Role != message.RoleModerator && req.Role != message.RoleAdmin {
+			hub.sendError(actor, op.requestID, message.ErrorBadRequest, fmt.Sprintf("Unknown role %q", req.Role))
+			return
+		}
+		if err := hub.moderation.SetRole(req.Target, req.Role); err != nil {
+			hub.log.Error("failed to save role", "target", req.Target, "err", err)
+		}
+		for _, client := range hub.clientsOf(req.Target, "") {
+			client.Role = req.Role
+		}
+		hub.notify(req.Target, fmt.Sprintf("%s made you %s", actor.Username, req.Role))
+		summary = fmt.Sprintf("%s made %s %s", actor.Username, req.Target, req.Role)
+	}
+	summary += because
+
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		Actor:    actor.Username,
+		Action:   req.Action,
+		Target:   req.Target,
+		Duration: req.Duration,
+		Reason:   req.Reason,
+		Role:     req.Role,
+	}
+	hub.log.Info("moderation", "actor", entry.Actor, "action", entry.Action, "target", entry.Target,
+		"duration", entry.Duration, "reason", entry.Reason, "role", entry.Role)
+	if err := hub.audit.Record(entry); err != nil {
+		hub.log.Error("failed to write audit log", "err", err)
+	}
+
+	// The actor gets the summary as the answer to the request, the rest of
+	// the staff as a notice. The target was already told.
+	notice := message.Notice{Message: summary}
+	for client := range hub.clients {
+		switch {
+		case client == actor:
+			hub.send(client, message.MakeReply(op.requestID, message.TypeNotice, notice))
+		case client.Role.AtLeast(message.RoleModerator) && client.Username != req.Target:
+			hub.send(client, message.MakeEnvelope(message.TypeNotice, notice))
+		}
+	}
+}
+
+// clientsOf returns the connected clients of username or connected from ip.
+// Empty arguments match nothing.
+func (hub *Hub) clientsOf(username string, ip string) []*ConnectedClient {
+	var clients []*ConnectedClient
+	for client := range hub.clients {
+		if (username != "" && client.Username == username) || (ip != "" && client.addr == ip) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// notify sends a notice to every connection of username.
+func (hub *Hub) notify(username string, text string) {
+	envelope := message.MakeEnvelope(message.TypeNotice, message.Notice{Message: text})
+	for _, client := range hub.clientsOf(username, "") {
+		hub.send(client, envelope)
+	}
+}
+
+// mutedReason tells, if a moderator muted username, why what they send is
+// refused.
+func (hub *Hub) mutedReason(username string) (string, bool) {
+	until, muted := hub.moderation.Muted(username)
+	if !muted {
+		return "", false
+	}
+	return "You are muted until " + until.Local().Format("15:04:05"), true
+}
+
+// disconnect closes the connection of client with message.CloseModerated,
+// after sending it reason as a notice if it understands them.
+func (hub *Hub) disconnect(client *ConnectedClient, reason string) {
+	if client.dropped || !hub.clients[client] {
+		return
+	}
+	client.dropped = true
+
+	// Close reasons are limited to 123 bytes.
+	closeReason := reason
+	if len(closeReason) > 120 {
+		closeReason = closeReason[:120]
+	}
+	out := outbound{close: &closeFrame{code: message.CloseModerated, reason: closeReason}}
+	if client.supports(message.TypeNotice) {
+		out.envelope = message.MakeEnvelope(message.TypeNotice, message.Notice{Message: reason})
+	}
+
+	select {
+	case client.send <- out:
+	default:
+		go client.Conn.Close(websocket.StatusCode(message.CloseModerated), closeReason)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+func TestMutedUserCannotEditOrReact(t *testing.T) {
+	hub := newHub()
+	hub.moderation.SetRole("mod", message.RoleModerator)
+	go hub.Run()
+	alice := connect(t, hub, "alice")
+	mod := connect(t, hub, "mod")
+
+	say(hub, alice, message.LobbyChannel, "before")
+	sent := expect[message.ChatMessage](t, alice, message.TypeChatMessage)
+
+	hub.moderations <- moderationOp{client: mod, requestID: "m", req: message.Moderation{Action: message.ModerationMute, Target: "alice"}}
+	expect[message.Notice](t, alice, message.TypeNotice)
+
+	muted := func(what string) {
+		t.Helper()
+		if err := expect[message.Error](t, alice, message.TypeError); err.Code != message.ErrorMuted {
+			t.Errorf("%s while muted: got %+v, want %s", what, err, message.ErrorMuted)
+		}
+	}
+
+	say(hub, alice, message.LobbyChannel, "during")
+	muted("sending")
+
+	hub.edits <- editOp{client: alice, requestID: "e", kind: message.TypeMessageEdit, id: sent.ID, text: "rewritten"}
+	muted("editing")
+
+	hub.reactions <- reactionOp{client: alice, requestID: "r", reaction: message.Reaction{MessageID: sent.ID, Emoji: "👍"}}
+	muted("reacting")
+
+	if msg, _ := hub.history.Get(sent.ID); msg.Message != "before" || len(msg.Reactions) != 0 {
+		t.Errorf("the message was changed to %+v", msg)
+	}
+
+	// Others are not affected.
+	hub.reactions <- reactionOp{client: mod, requestID: "r", reaction: message.Reaction{MessageID: sent.ID, Emoji: "👍"}}
+	if r := expect[message.Reaction](t, mod, message.TypeReaction); r.Username != "mod" {
+		t.Errorf("mod reacted with %+v", r)
+	}
+
+	// Deleting is still allowed.
+	hub.edits <- editOp{client: alice, requestID: "d", kind: message.TypeMessageDelete, id: sent.ID}
+	if del := expect[message.MessageDelete](t, alice, message.TypeMessageDelete); del.ID != sent.ID {
+		t.Errorf("deleted %+v, want %s", del, sent.ID)
+	}
+}
+
+func TestModeratorCannotEditOthers(t *testing.T) {
+	hub := newHub()
+	hub.moderation.SetRole("mod", message.RoleModerator)
+	hub.moderation.SetRole("root", message.RoleAdmin)
+	go hub.Run()
+	alice := connect(t, hub, "alice")
+	mod := connect(t, hub, "mod")
+	root := connect(t, hub, "root")
+
+	say(hub, alice, message.LobbyChannel, "original")
+	sent := expect[message.ChatMessage](t, alice, message.TypeChatMessage)
+
+	hub.edits <- editOp{client: mod, requestID: "e", kind: message.TypeMessageEdit, id: sent.ID, text: "rewritten"}
+	if err := expect[message.Error](t, mod, message.TypeError); err.Code != message.ErrorForbidden {
+		t.Errorf("moderator edit: got %+v, want %s", err, message.ErrorForbidden)
+	}
+	if msg, _ := hub.history.Get(sent.ID); msg.Message != "original" {
+		t.Errorf("the moderator rewrote the message to %q", msg.Message)
+	}
+
+	hub.edits <- editOp{client: root, requestID: "e", kind: message.TypeMessageEdit, id: sent.ID, text: "fixed"}
+	if edit := expect[message.MessageEdit](t, root, message.TypeMessageEdit); edit.Message != "fixed" {
+		t.Errorf("admin edit: got %+v", edit)
+	}
+
+	hub.edits <- editOp{client: mod, requestID: "d", kind: message.TypeMessageDelete, id: sent.ID}
+	if del := expect[message.MessageDelete](t, mod, message.TypeMessageDelete); del.ID != sent.ID {
+		t.Errorf("moderator delete: got %+v", del)
+	}
+}
+
+func TestMutesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	ms, err := OpenModerationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour).Round(time.Second)
+	ms.Mute("alice", until)
+	ms.Mute("bob", time.Now().Add(-time.Second))
+
+	ms, err = OpenModerationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := ms.Muted("alice"); !ok || !got.Equal(until) {
+		t.Errorf("Muted(alice) = %v, %v after reopening, want %v", got, ok, until)
+	}
+	if _, ok := ms.Muted("bob"); ok {
+		t.Error("an expired mute is in force")
+	}
+	if found, _ := ms.Unmute("alice"); !found {
+		t.Error("Unmute(alice) found no mute")
+	}
+	if _, ok := ms.Muted("alice"); ok {
+		t.Error("alice is still muted")
+	}
+}
+
+func TestMuteUnknownUser(t *testing.T) {
+	hub := newHub()
+	hub.moderation.SetRole("mod", message.RoleModerator)
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	hub.SetModeration(hub.moderation, audit)
+	go hub.Run()
+	mod := connect(t, hub, "mod")
+
+	hub.moderations <- moderationOp{client: mod, requestID: "m", req: message.Moderation{Action: message.ModerationMute, Target: "alcie"}}
+	if err := expect[message.Error](t, mod, message.TypeError); err.Code != message.ErrorUnknownDestination {
+		t.Errorf("muting a typo: got %+v, want %s", err, message.ErrorUnknownDestination)
+	}
+	if _, ok := hub.moderation.Muted("alcie"); ok {
+		t.Error("the typo was muted")
+	}
+	if data, _ := os.ReadFile(auditPath); len(data) != 0 {
+		t.Errorf("the refused mute was audited: %s", data)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+// OfflineOptions configures how direct messages to users who are not
+// connected are kept until they log in again.
+type OfflineOptions struct {
+	// MaxMessages is how many messages are queued per user; the oldest are
+	// discarded beyond that. Zero disables the queue.
+	MaxMessages int
+	// MaxAge discards queued messages older than this. Zero keeps them
+	// until they are delivered.
+	MaxAge time.Duration
+	// IsKnownUser reports whether username has an account. Users who
+	// connected since the server started are always known.
+	IsKnownUser func(username string) bool
+}
+
+var DefaultOfflineOptions = OfflineOptions{
+	MaxMessages: 100,
+	MaxAge:      time.Hour * 24 * 7,
+}
+
+// isOnline reports whether username has a registered connection.
+func (hub *Hub) isOnline(username string) bool {
+	for client := range hub.clients {
+		if client.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (hub *Hub) isKnownUser(username string) bool {
+	if hub.seenUsers[username] {
+		return true
+	}
+	return hub.offline.IsKnownUser != nil && hub.offline.IsKnownUser(username)
+}
+
+// queueOffline keeps a direct message for its recipient if they are a known
+// user that is not connected, and tells the sender it was queued.
+func (hub *Hub) queueOffline(msg message.ChatMessage) {
+	if hub.offline.MaxMessages <= 0 || msg.Destination == msg.Username {
+		return
+	}
+	if hub.isOnline(msg.Destination) || !hub.isKnownUser(msg.Destination) {
+		return
+	}
+
+	queue := append(hub.pruneOffline(msg.Destination), msg)
+	if len(queue) > hub.offline.MaxMessages {
+		queue = queue[len(queue)-hub.offline.MaxMessages:]
+	}
+	hub.pending[msg.Destination] = queue
+
+	envelope := message.MakeEnvelope(message.TypeReceipt, message.Receipt{
+		MessageID: msg.ID,
+		Sender:    msg.Username,
+		Reader:    msg.Destination,
+		Status:    message.ReceiptQueued,
+	})
+	for client := range hub.clients {
+		if client.Username == msg.Username {
+			hub.send(client, envelope)
+		}
+	}
+}
+
+// pruneOffline drops the expired messages queued for username and returns
+// the rest.
+func (hub *Hub) pruneOffline(username string) []message.ChatMessage {
+	queue := hub.pending[username]
+	if hub.offline.MaxAge <= 0 {
+		return queue
+	}
+
+	cutoff := time.Now().Add(-hub.offline.MaxAge)
+	kept := queue[:0]
+	for _, msg := range queue {
+		if msg.Timestamp.After(cutoff) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// deliverOffline sends a client that just logged in the direct messages
+// queued for it while it was away, oldest first.
+func (hub *Hub) deliverOffline(client *ConnectedClient) {
+	queue := hub.pruneOffline(client.Username)
+	delete(hub.pending, client.Username)
+
+	for _, msg := range queue {
+		hub.sendWithReceipt(client, message.MakeEnvelope(message.TypeChatMessage, msg), message.Receipt{
+			MessageID: msg.ID,
+			Sender:    msg.Username,
+			Reader:    client.Username,
+			Status:    message.ReceiptDelivered,
+		})
+	}
+}
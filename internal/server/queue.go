@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	message "chatui/internal/protocol"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// OverflowPolicy decides what happens when a client's send queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest discards the oldest queued envelope to make room.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDisconnect closes the connection of the slow client.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// QueueOptions configures the outbound queue every connected client gets, so
+// that a slow reader only ever delays itself and never the hub.
+type QueueOptions struct {
+	Size         int
+	WriteTimeout time.Duration
+	Policy       OverflowPolicy
+}
+
+var DefaultQueueOptions = QueueOptions{
+	Size:         256,
+	WriteTimeout: time.Second * 10,
+	Policy:       OverflowDropOldest,
+}
+
+// ParseOverflowPolicy validates a policy name given on the command line.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case OverflowDropOldest, OverflowDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q, expected %q or %q", name, OverflowDropOldest, OverflowDisconnect)
+	}
+}
+
+// outbound is an envelope waiting in a client's send queue.
+type outbound struct {
+	envelope message.Envelope
+	// receipt, when set, is handed back to the hub once the envelope has
+	// been written to the socket.
+	receipt *message.Receipt
+	// close, when set, closes the connection after the envelope, if any,
+	// was written.
+	close *closeFrame
+}
+
+type closeFrame struct {
+	code   int
+	reason string
+}
+
+// startWriter creates the client's send queue and the goroutine draining it
+// to the socket. The goroutine exits once the hub closes the queue.
+func (hub *Hub) startWriter(client *ConnectedClient) {
+	client.send = make(chan outbound, hub.queue.Size)
+
+	go func() {
+		for out := range client.send {
+			if out.envelope.Type != "" {
+				ctx, cancel := context.WithTimeout(context.Background(), hub.queue.WriteTimeout)
+				start := time.Now()
+				err := wsjson.Write(ctx, client.Conn, out.envelope)
+				cancel()
+				hub.metrics.observeWrite(client.Username, time.Since(start))
+				if err != nil {
+					// The reader in ServeHTTP notices and unregisters the client.
+					client.Conn.CloseNow()
+					return
+				}
+			}
+			if out.receipt != nil {
+				hub.receipts <- *out.receipt
+			}
+			if out.close != nil {
+				client.Conn.Close(websocket.StatusCode(out.close.code), out.close.reason)
+				return
+			}
+		}
+	}()
+}
+
+// send queues envelope for client without ever blocking the hub. Clients
+// that are no longer registered are skipped, as their queue is closed, and
+// so are envelopes the client did not announce support for.
+func (hub *Hub) send(client *ConnectedClient, envelope message.Envelope) {
+	hub.enqueue(client, outbound{envelope: envelope})
+}
+
+// sendWithReceipt is like send, but once the envelope reached the client's
+// socket receipt is routed back through the hub.
+func (hub *Hub) sendWithReceipt(client *ConnectedClient, envelope message.Envelope, receipt message.Receipt) {
+	hub.enqueue(client, outbound{envelope: envelope, receipt: &receipt})
+}
+
+func (hub *Hub) enqueue(client *ConnectedClient, out outbound) {
+	if client.dropped || !hub.clients[client] || !client.supports(out.envelope.Type) {
+		return
+	}
+
+	select {
+	case client.send <- out:
+		return
+	default:
+	}
+
+	switch hub.queue.Policy {
+	case OverflowDisconnect:
+		client.log.Warn("disconnecting slow client")
+		client.dropped = true
+		go client.Conn.Close(websocket.StatusTryAgainLater, "client too slow")
+	default:
+		select {
+		case <-client.send:
+		default:
+		}
+		select {
+		case client.send <- out:
+		default:
+		}
+	}
+}
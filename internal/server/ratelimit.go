@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	message "chatui/internal/protocol"
+
+	"github.com/coder/websocket"
+)
+
+// RateLimit allows Count events per Per, in bursts of up to Count. A zero
+// Count disables the limit.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRateLimit reads a limit given on the command line as "count/duration",
+// such as "20/10s". "0" disables the limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	if s == "0" {
+		return RateLimit{}, nil
+	}
+	count, per, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n < 1 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected count/duration such as 20/10s", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected count/duration such as 20/10s", s)
+	}
+	return RateLimit{Count: n, Per: d}, nil
+}
+
+func (l RateLimit) String() string {
+	if l.Count == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%v", l.Count, l.Per)
+}
+
+// RateLimitOptions configures flood protection. Every limit applies to each
+// user and, multiplied by IPFactor, to each IP address. Logins count against
+// the username tried from each address, so that nobody can lock a user out
+// by failing to log in as them.
+type RateLimitOptions struct {
+	// Messages limits chat messages, edits, deletions, reactions, read
+	// receipts and channel requests.
+	Messages RateLimit
+	Logins   RateLimit
+	Typing   RateLimit
+	IPFactor int
+
+	// A connection going over a limit gets a warning, is muted for
+	// MuteDuration after MuteAfter strikes and disconnected after
+	// DisconnectAfter. Strikes are forgiven after StrikeWindow without any.
+	MuteAfter       int
+	MuteDuration    time.Duration
+	DisconnectAfter int
+	StrikeWindow    time.Duration
+}
+
+var DefaultRateLimitOptions = RateLimitOptions{
+	Messages: RateLimit{Count: 20, Per: 10 * time.Second},
+	Logins:   RateLimit{Count: 10, Per: time.Minute},
+	Typing:   RateLimit{Count: 10, Per: 10 * time.Second},
+	IPFactor: 4,
+
+	MuteAfter:       5,
+	MuteDuration:    time.Minute,
+	DisconnectAfter: 15,
+	StrikeWindow:    time.Minute,
+}
+
+// rateKind names the group of envelopes a limit applies to.
+type rateKind string
+
+const (
+	rateMessages rateKind = "messages"
+	rateLogins   rateKind = "logins"
+	rateTyping   rateKind = "typing"
+)
+
+// rateKindOf returns the limit an envelope type counts against, or "" for
+// the ones that are not limited.
+func rateKindOf(t message.MessageType) rateKind {
+	switch t {
+	case message.TypeChatMessage, message.TypeMessageEdit, message.TypeMessageDelete, message.TypeReaction,
+		message.TypeReceipt, message.TypeChannelCreate, message.TypeChannelJoin, message.TypeChannelLeave,
+		message.TypeChannelList, message.TypeThread, message.TypeModeration:
+		return rateMessages
+	case message.TypeTyping:
+		return rateTyping
+	default:
+		return ""
+	}
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per user and per IP address for every
+// kind of limited event. It is shared by all connections.
+type rateLimiter struct {
+	mu        sync.Mutex
+	opts      RateLimitOptions
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func createRateLimiter(opts RateLimitOptions) *rateLimiter {
+	return &rateLimiter{opts: opts, buckets: make(map[string]*tokenBucket)}
+}
+
+// options returns the limits in force.
+func (l *rateLimiter) options() RateLimitOptions {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.opts
+}
+
+// setOptions replaces the limits, keeping the buckets filled so far.
+func (l *rateLimiter) setOptions(opts RateLimitOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.opts = opts
+}
+
+func (l *rateLimiter) limit(kind rateKind) RateLimit {
+	switch kind {
+	case rateMessages:
+		return l.opts.Messages
+	case rateLogins:
+		return l.opts.Logins
+	default:
+		return l.opts.Typing
+	}
+}
+
+// allow takes a token from the buckets of both user and ip, or from neither
+// if one of them is empty. The bucket of a username tried at login is kept
+// for each address.
+func (l *rateLimiter) allow(kind rateKind, user string, ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limit(kind)
+	if limit.Count == 0 {
+		return true
+	}
+	rate := float64(limit.Count) / limit.Per.Seconds()
+	factor := float64(max(l.opts.IPFactor, 1))
+
+	now := time.Now()
+	l.prune(now)
+
+	userKey := string(kind) + "\x00user\x00" + user
+	if kind == rateLogins {
+		userKey += "\x00" + ip
+	}
+	userBucket := l.bucket(userKey, now, rate, float64(limit.Count))
+	ipBucket := l.bucket(string(kind)+"\x00ip\x00"+ip, now, rate*factor, float64(limit.Count)*factor)
+	if userBucket.tokens < 1 || ipBucket.tokens < 1 {
+		return false
+	}
+	userBucket.tokens--
+	ipBucket.tokens--
+	return true
+}
+
+// bucket returns the bucket stored under key, refilled up to now.
+func (l *rateLimiter) bucket(key string, now time.Time, rate float64, burst float64) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b
+}
+
+// prune forgets, once a minute, the buckets that have had time to refill
+// completely since they were last used; they would start full anyway.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	longest := max(l.opts.Messages.Per, l.opts.Logins.Per, l.opts.Typing.Per)
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > longest {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// floodAction is what happens to a connection going over a limit.
+type floodAction int
+
+const (
+	floodDrop floodAction = iota
+	floodWarn
+	floodMute
+	floodDisconnect
+)
+
+// floodGuard counts the strikes of one connection. It is only used by the
+// goroutine reading from the connection.
+type floodGuard struct {
+	strikes    int
+	lastStrike time.Time
+	mutedUntil time.Time
+}
+
+func (g *floodGuard) muted(now time.Time) bool {
+	return now.Before(g.mutedUntil)
+}
+
+// strike records an envelope over the limit and decides what to do.
+func (g *floodGuard) strike(now time.Time, opts RateLimitOptions) floodAction {
+	if now.Sub(g.lastStrike) > opts.StrikeWindow {
+		g.strikes = 0
+	}
+	g.strikes++
+	g.lastStrike = now
+
+	switch {
+	case opts.DisconnectAfter > 0 && g.strikes >= opts.DisconnectAfter:
+		return floodDisconnect
+	case opts.MuteAfter > 0 && g.strikes == opts.MuteAfter:
+		g.mutedUntil = now.Add(opts.MuteDuration)
+		return floodMute
+	case g.strikes == 1:
+		return floodWarn
+	default:
+		return floodDrop
+	}
+}
+
+// remoteIP returns the IP address a request came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SetRateLimits replaces the flood protection. It may be called while the
+// server runs; what clients have used up of the old limits counts against
+// the new ones.
+func (cs *ChatServer) SetRateLimits(opts RateLimitOptions) {
+	cs.limits.setOptions(opts)
+}
+
+// checkRate reports whether an envelope of the given kind sent by user may be
+// handled, warning, muting or disconnecting clients that keep going over the
+// limits. ok is false if the envelope must be dropped, closed if the
+// connection was closed.
+func (cs ChatServer) checkRate(ctx context.Context, client *ConnectedClient, kind rateKind, user string, requestID string) (ok bool, closed bool) {
+	now := time.Now()
+	muted := kind != rateLogins && client.flood.muted(now)
+	if !muted && cs.limits.allow(kind, user, client.addr) {
+		return true, false
+	}
+
+	log := client.log.With("limit", kind)
+	if kind == rateLogins {
+		log = log.With("login_as", user)
+	}
+
+	opts := cs.limits.options()
+	switch client.flood.strike(now, opts) {
+	case floodDisconnect:
+		log.Warn("disconnecting for flooding")
+		client.Conn.Close(websocket.StatusPolicyViolation, "Disconnected for flooding")
+		return false, true
+	case floodMute:
+		log.Warn("muting for flooding", "duration", opts.MuteDuration)
+		cs.rejectRate(ctx, client, kind, requestID, message.ErrorMuted,
+			fmt.Sprintf("You are muted for %v for sending too fast", opts.MuteDuration))
+	case floodWarn:
+		cs.rejectRate(ctx, client, kind, requestID, message.ErrorRateLimited,
+			"You are sending too fast; keep going and you will be muted")
+	default:
+		if muted {
+			cs.rejectRate(ctx, client, kind, requestID, message.ErrorMuted,
+				fmt.Sprintf("You are muted for another %v", client.flood.mutedUntil.Sub(now).Round(time.Second)))
+		} else if kind != rateTyping {
+			cs.rejectRate(ctx, client, kind, requestID, message.ErrorRateLimited, "Rate limited, slow down")
+		}
+	}
+	return false, false
+}
+
+func (cs ChatServer) rejectRate(ctx context.Context, client *ConnectedClient, kind rateKind, requestID string, code message.ErrorCode, reason string) {
+	if kind == rateLogins {
+		cs.writeLoginFailure(ctx, client, loginRateLimited, "Too many login attempts, try again later")
+		return
+	}
+	cs.writeError(ctx, client, requestID, code, reason)
+}
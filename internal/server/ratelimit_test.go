@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want RateLimit
+		ok   bool
+	}{
+		{"20/10s", RateLimit{Count: 20, Per: 10 * time.Second}, true},
+		{"1/1m", RateLimit{Count: 1, Per: time.Minute}, true},
+		{"0", RateLimit{}, true},
+		{"20", RateLimit{}, false},
+		{"0/10s", RateLimit{}, false},
+		{"20/0s", RateLimit{}, false},
+		{"x/10s", RateLimit{}, false},
+	} {
+		got, err := ParseRateLimit(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseRateLimit(%q) = %v, %v", tt.in, got, err)
+		}
+		if again, err := ParseRateLimit(got.String()); tt.ok && (err != nil || again != got) {
+			t.Errorf("%q does not parse back to %v", got.String(), got)
+		}
+	}
+}
+
+func TestRateLimiterPerUserAndIP(t *testing.T) {
+	opts := DefaultRateLimitOptions
+	opts.Messages = RateLimit{Count: 2, Per: time.Hour}
+	opts.IPFactor = 2
+	l := createRateLimiter(opts)
+
+	if !l.allow(rateMessages, "alice", "10.0.0.1") || !l.allow(rateMessages, "alice", "10.0.0.2") {
+		t.Fatal("the first messages were refused")
+	}
+	if l.allow(rateMessages, "alice", "10.0.0.3") {
+		t.Error("alice went over the user limit by changing address")
+	}
+
+	// The address allows twice as much, shared by its users.
+	if !l.allow(rateMessages, "bob", "10.0.0.1") || !l.allow(rateMessages, "bob", "10.0.0.1") {
+		t.Fatal("bob was refused")
+	}
+	if !l.allow(rateMessages, "carol", "10.0.0.1") {
+		t.Fatal("carol was refused")
+	}
+	if l.allow(rateMessages, "dave", "10.0.0.1") {
+		t.Error("10.0.0.1 went over its limit")
+	}
+}
+
+func TestRateLimiterLoginLockout(t *testing.T) {
+	opts := DefaultRateLimitOptions
+	opts.Logins = RateLimit{Count: 3, Per: time.Hour}
+	l := createRateLimiter(opts)
+
+	for range 3 {
+		l.allow(rateLogins, "victim", "192.0.2.66")
+	}
+	if l.allow(rateLogins, "victim", "192.0.2.66") {
+		t.Error("the attacker could keep trying")
+	}
+	if !l.allow(rateLogins, "victim", "198.51.100.7") {
+		t.Error("failed logins from another address locked the victim out")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	opts := DefaultRateLimitOptions
+	opts.Typing = RateLimit{}
+	l := createRateLimiter(opts)
+	for range 1000 {
+		if !l.allow(rateTyping, "alice", "10.0.0.1") {
+			t.Fatal("a disabled limit refused typing")
+		}
+	}
+}
+
+func TestFloodGuardEscalation(t *testing.T) {
+	opts := DefaultRateLimitOptions
+	opts.MuteAfter = 2
+	opts.MuteDuration = time.Minute
+	opts.DisconnectAfter = 4
+	opts.StrikeWindow = 10 * time.Second
+
+	var g floodGuard
+	now := time.Now()
+	want := []floodAction{floodWarn, floodMute, floodDrop, floodDisconnect}
+	for i, action := range want {
+		if got := g.strike(now, opts); got != action {
+			t.Fatalf("strike %d: got %v, want %v", i+1, got, action)
+		}
+		if i == 1 && !g.muted(now.Add(59*time.Second)) {
+			t.Error("not muted for MuteDuration")
+		}
+	}
+
+	// Strikes are forgiven after the window.
+	g = floodGuard{}
+	g.strike(now, opts)
+	if got := g.strike(now.Add(11*time.Second), opts); got != floodWarn {
+		t.Errorf("after the strike window: got %v, want a warning", got)
+	}
+
+	// Zero disables muting and disconnecting.
+	opts.MuteAfter, opts.DisconnectAfter = 0, 0
+	g = floodGuard{}
+	for range 100 {
+		if got := g.strike(now, opts); got == floodMute || got == floodDisconnect {
+			t.Fatalf("got %v with escalation disabled", got)
+		}
+	}
+}
+
+func TestRateKindOf(t *testing.T) {
+	for _, typ := range []message.MessageType{
+		message.TypeChatMessage, message.TypeThread, message.TypeModeration, message.TypeChannelList, message.TypeReceipt,
+	} {
+		if kind := rateKindOf(typ); kind != rateMessages {
+			t.Errorf("%s counts against %q, want %q", typ, kind, rateMessages)
+		}
+	}
+	if kind := rateKindOf(message.TypeTyping); kind != rateTyping {
+		t.Errorf("typing counts against %q", kind)
+	}
+}
+
+func TestRateLimitBeforeLogin(t *testing.T) {
+	cs := CreateChatServer(discard, startHub(t), nil)
+	opts := DefaultRateLimitOptions
+	opts.Logins = RateLimit{Count: 2, Per: time.Hour}
+	cs.SetRateLimits(opts)
+	c := dialServer(t, cs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i, want := range []string{"Expected login request", "Expected login request", "Too many login attempts, try again later"} {
+		if err := wsjson.Write(ctx, c, message.MakeEnvelope(message.TypeChannelList, message.ChannelList{})); err != nil {
+			t.Fatal(err)
+		}
+		var env message.Envelope
+		if err := wsjson.Read(ctx, c, &env); err != nil {
+			t.Fatal(err)
+		}
+		var resp message.LoginResponse
+		json.Unmarshal(env.Data, &resp)
+		if env.Type != message.TypeLoginResponse || resp.Message != want {
+			t.Errorf("envelope %d: got %s %+v, want %q", i+1, env.Type, resp, want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"slices"
+
+	message "chatui/internal/protocol"
+)
+
+// reactionOp asks the hub to add, or remove, a reaction to a message.
+type reactionOp struct {
+	client    *ConnectedClient
+	requestID string
+	reaction  message.Reaction
+}
+
+func (hub *Hub) handleReaction(op reactionOp) {
+	username := op.client.Username
+	reaction := op.reaction
+
+	if reason, muted := hub.mutedReason(username); muted {
+		hub.sendError(op.client, op.requestID, message.ErrorMuted, reason)
+		return
+	}
+
+	msg, ok := hub.history.Get(reaction.MessageID)
+	if !ok || msg.Deleted || !hub.canSee(username, msg) {
+		hub.sendError(op.client, op.requestID, message.ErrorUnknownMessage, "Message not found")
+		return
+	}
+
+	users := msg.Reactions[reaction.Emoji]
+	if reaction.Remove {
+		users = slices.DeleteFunc(slices.Clone(users), func(u string) bool { return u == username })
+	} else if !slices.Contains(users, username) {
+		users = append(slices.Clone(users), username)
+	}
+
+	reactions := make(map[string][]string, len(msg.Reactions)+1)
+	for emoji, u := range msg.Reactions {
+		reactions[emoji] = u
+	}
+	if len(users) > 0 {
+		reactions[reaction.Emoji] = users
+	} else {
+		delete(reactions, reaction.Emoji)
+	}
+	msg.Reactions = reactions
+
+	if err := hub.history.Update(msg); err != nil {
+		hub.log.Error("failed to record reaction in history", "id", msg.ID, "err", err)
+	}
+	hub.updateOffline(msg)
+
+	reaction.Username = username
+	reaction.Author = msg.Username
+	reaction.Destination = msg.Destination
+	reaction.Reactions = msg.Reactions
+	envelope := message.MakeEnvelope(message.TypeReaction, reaction)
+	for _, client := range hub.audience(msg.Username, msg.Destination) {
+		if client == op.client {
+			hub.send(client, message.MakeReply(op.requestID, message.TypeReaction, reaction))
+			continue
+		}
+		hub.send(client, envelope)
+	}
+}
+
+// canSee reports whether username is part of the conversation msg was sent
+// to.
+func (hub *Hub) canSee(username string, msg message.ChatMessage) bool {
+	if message.IsChannel(msg.Destination) {
+		return hub.isMember(msg.Destination, username)
+	}
+	return msg.Username == username || msg.Destination == username
+}
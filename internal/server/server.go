@@ -3,10 +3,18 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	message "chatui/internal/protocol"
 
@@ -17,66 +25,248 @@ import (
 type ConnectedClient struct {
 	Conn     *websocket.Conn
 	Username string
+	// Role is looked up when the client logs in and kept up to date by the
+	// hub afterwards.
+	Role message.Role
+	// certName is the common name of the client's TLS certificate. When
+	// set, it is used as the username and no password is required.
+	certName string
+
+	// send is the outbound queue drained by the client's writer goroutine.
+	// Only the hub writes to it or closes it.
+	send chan outbound
+	// dropped is set by the hub once the client was disconnected for being
+	// too slow.
+	dropped bool
+	// resumeFrom is the last message sequence number the client saw before
+	// reconnecting, or zero for a fresh login.
+	resumeFrom uint64
+	// capabilities were agreed on in the hello handshake. They are empty
+	// for clients that predate it.
+	capabilities []message.Capability
+	// addr is the IP address the client connected from.
+	addr string
+	// motd is the message of the day in force when the client logged in.
+	motd string
+	// log carries the connection ID, address and, once logged in, username.
+	log *slog.Logger
+	// flood counts how often the client went over the rate limits.
+	flood floodGuard
 }
 
-type usernameCheck struct {
-	username string
-	response chan bool
+// supports reports whether the client can be sent envelopes of type t.
+func (client *ConnectedClient) supports(t message.MessageType) bool {
+	capability := message.RequiredCapability(t)
+	return capability == "" || slices.Contains(client.capabilities, capability)
+}
+
+// historyReplayLimit is how many messages of each conversation are sent to
+// a user right after they log in.
+const historyReplayLimit = 50
+
+// historyResumeLimit caps how many missed messages are replayed to a client
+// resuming a dropped session.
+const historyResumeLimit = 1000
+
+// chatRequest is a chat message accepted from client, waiting to be routed by
+// the hub.
+type chatRequest struct {
+	client    *ConnectedClient
+	requestID string
+	msg       message.ChatMessage
+	// result, if set, is told whether the message was delivered. It must be
+	// buffered so the hub never waits on it.
+	result chan<- chatResult
+}
+
+// chatResult is the outcome of a chatRequest: the message as delivered, or
+// why it was rejected.
+type chatResult struct {
+	msg    message.ChatMessage
+	code   message.ErrorCode
+	reason string
+}
+
+func (req chatRequest) reject(hub *Hub, code message.ErrorCode, reason string) {
+	hub.sendError(req.client, req.requestID, code, reason)
+	if req.result != nil {
+		req.result <- chatResult{code: code, reason: reason}
+	}
+	if req.client == nil && req.result == nil {
+		// Nobody else would hear of it: a bot posted it.
+		hub.log.Warn("dropping bot message", "bot", req.msg.Username, "destination", req.msg.Destination, "code", code, "reason", reason)
+	}
 }
 
 type Hub struct {
-	clients       map[*ConnectedClient]bool
-	broadcast     chan message.ChatMessage
-	register      chan *ConnectedClient
-	unregister    chan *ConnectedClient
-	checkUsername chan usernameCheck
+	clients    map[*ConnectedClient]bool
+	broadcast  chan chatRequest
+	typing     chan message.Typing
+	receipts   chan message.Receipt
+	register   chan *ConnectedClient
+	unregister chan *ConnectedClient
+	channelOps chan channelOp
+	edits      chan editOp
+	reactions  chan reactionOp
+	threads    chan threadRequest
+	rejections chan rejection
+	bots       map[string]*botRunner
+	webhooks   []*webhookSender
+	channels   map[string]map[string]bool
+	history    HistoryStore
+	queue      QueueOptions
+	seq        uint64
+	// conversationSeqs holds the last ConversationSeq handed out, keyed by
+	// conversationKey. It is filled from the history on first use.
+	conversationSeqs map[string]uint64
+
+	// pending holds the direct messages waiting for offline users.
+	offline   OfflineOptions
+	pending   map[string][]message.ChatMessage
+	seenUsers map[string]bool
+
+	// moderation keeps roles, bans and mutes.
+	moderations chan moderationOp
+	moderation  *ModerationStore
+	audit       *AuditLog
+
+	log     *slog.Logger
+	metrics *Metrics
+	pings   chan chan struct{}
 }
 
-func CreateHub() Hub {
-	return Hub{
-		clients:       make(map[*ConnectedClient]bool),
-		broadcast:     make(chan message.ChatMessage),
-		register:      make(chan *ConnectedClient),
-		unregister:    make(chan *ConnectedClient),
-		checkUsername: make(chan usernameCheck),
+func CreateHub(history HistoryStore, queue QueueOptions, offline OfflineOptions) *Hub {
+	return &Hub{
+		clients:    make(map[*ConnectedClient]bool),
+		broadcast:  make(chan chatRequest),
+		typing:     make(chan message.Typing),
+		receipts:   make(chan message.Receipt),
+		register:   make(chan *ConnectedClient),
+		unregister: make(chan *ConnectedClient),
+		channelOps: make(chan channelOp),
+		edits:      make(chan editOp),
+		reactions:  make(chan reactionOp),
+		threads:    make(chan threadRequest),
+		rejections: make(chan rejection),
+		bots:       make(map[string]*botRunner),
+		channels:   make(map[string]map[string]bool),
+		history:    history,
+		queue:      queue,
+		seq:        history.LastSeq(),
+
+		conversationSeqs: make(map[string]uint64),
+
+		offline:   offline,
+		pending:   make(map[string][]message.ChatMessage),
+		seenUsers: make(map[string]bool),
+
+		moderations: make(chan moderationOp),
+		moderation:  createModerationStore(""),
+
+		log:     slog.Default(),
+		metrics: createMetrics(),
+		pings:   make(chan chan struct{}),
 	}
 }
 
+// SetLogger sets where the hub logs. It must be called before Run and
+// before bots or webhooks are added.
+func (hub *Hub) SetLogger(logger *slog.Logger) {
+	hub.log = logger
+}
+
+// ServerOptions are the limits the server puts on connections and what it
+// tells users when they log in.
+type ServerOptions struct {
+	// MaxMessageLength is the most characters a chat message may have.
+	MaxMessageLength int
+	// MaxUsernameLength is the most bytes a username may have.
+	MaxUsernameLength int
+	// MaxConnectionTime is how long a connection may stay open; clients
+	// reconnect once it is closed.
+	MaxConnectionTime time.Duration
+	// AllowedOrigins are host patterns, as in path.Match, of the pages that
+	// may open a connection from a browser besides the server's own.
+	AllowedOrigins []string
+	// MOTD is shown to users when they log in, unless it is empty.
+	MOTD string
+}
+
+var DefaultServerOptions = ServerOptions{
+	MaxMessageLength:  message.MaxMessageLength,
+	MaxUsernameLength: 32,
+	MaxConnectionTime: time.Hour * 24,
+}
+
+// connectionIDs numbers connections, so the log lines of one can be told
+// apart from those of another by the same user.
+var connectionIDs atomic.Uint64
+
 type ChatServer struct {
-	logf func(f string, v ...any)
-	hub  Hub
+	log     *slog.Logger
+	hub     *Hub
+	users   *UserStore
+	apiKeys map[string]string
+	limits  *rateLimiter
+	options *atomic.Pointer[ServerOptions]
 }
 
-func CreateChatServer(logf func(f string, v ...any), hub Hub) *ChatServer {
+func CreateChatServer(logger *slog.Logger, hub *Hub, users *UserStore) *ChatServer {
 	return &ChatServer{
-		logf: logf,
-		hub:  hub,
+		log:     logger,
+		hub:     hub,
+		users:   users,
+		limits:  createRateLimiter(DefaultRateLimitOptions),
+		options: newOptions(DefaultServerOptions),
 	}
 }
 
+func newOptions(opts ServerOptions) *atomic.Pointer[ServerOptions] {
+	p := new(atomic.Pointer[ServerOptions])
+	p.Store(&opts)
+	return p
+}
+
+// SetOptions replaces the server options. It may be called while the server
+// runs; connections already open keep their MaxConnectionTime.
+func (cs *ChatServer) SetOptions(opts ServerOptions) {
+	cs.options.Store(&opts)
+}
+
 func (cs ChatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c, err := websocket.Accept(w, r, nil)
+	opts := cs.options.Load()
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: opts.AllowedOrigins})
 	if err != nil {
-		cs.logf("websocket accept error: %v", err)
+		cs.log.Warn("websocket accept error", "remote_addr", remoteIP(r), "err", err)
 		return
 	}
 	defer c.CloseNow()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Hour*24)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.MaxConnectionTime)
 	defer cancel()
 
 	client := &ConnectedClient{
-		Conn: c,
+		Conn:     c,
+		certName: certificateUsername(r),
+		addr:     remoteIP(r),
 	}
+	client.log = cs.log.With("conn_id", connectionIDs.Add(1), "remote_addr", client.addr)
+	client.log.Debug("connected")
 
 	if !cs.handleUsernameRegistration(ctx, client) {
 		return
 	}
+	client.motd = cs.options.Load().MOTD
+	client.log = client.log.With("username", client.Username)
+	client.log.Info("logged in", "role", client.Role, "resume_from", client.resumeFrom)
+	defer client.log.Info("disconnected")
+
+	cs.hub.startWriter(client)
 
-	cs.hub.register <- client
+	submit(cs.hub.metrics, "register", cs.hub.register, client)
 
 	defer func() {
-		cs.hub.unregister <- client
+		submit(cs.hub.metrics, "unregister", cs.hub.unregister, client)
 	}()
 
 	for {
@@ -85,19 +275,140 @@ func (cs ChatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			break
 		}
-		if env.Type != message.TypeChatMessage {
-			continue
+
+		if kind := rateKindOf(env.Type); kind != "" {
+			ok, closed := cs.checkRate(ctx, client, kind, client.Username, env.RequestID)
+			if closed {
+				return
+			}
+			if !ok {
+				continue
+			}
 		}
-		var msg message.ChatMessage
 
-		json.Unmarshal(env.Data, &msg)
+		switch env.Type {
+		case message.TypeChatMessage:
+			var msg message.ChatMessage
 
-		if len(msg.Message) > 200 {
-			msg.Message = msg.Message[:200]
-		}
+			if err := json.Unmarshal(env.Data, &msg); err != nil {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed chat message")
+				continue
+			}
+
+			if strings.TrimSpace(msg.Message) == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorEmptyMessage, "Message cannot be empty")
+				continue
+			}
+
+			if limit := cs.options.Load().MaxMessageLength; utf8.RuneCountInString(msg.Message) > limit {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorMessageTooLong,
+					fmt.Sprintf("Message cannot be longer than %d characters", limit))
+				continue
+			}
+
+			// Only keep what clients may set; the rest is the server's to fill in.
+			msg = message.ChatMessage{
+				ID:          newMessageID(),
+				Username:    client.Username,
+				Destination: msg.Destination,
+				Message:     msg.Message,
+				Timestamp:   time.Now().UTC(),
+				ParentID:    msg.ParentID,
+				Action:      msg.Action,
+			}
+			submit(cs.hub.metrics, "broadcast", cs.hub.broadcast, chatRequest{client: client, requestID: env.RequestID, msg: msg})
+		case message.TypeChannelCreate, message.TypeChannelJoin, message.TypeChannelLeave, message.TypeChannelList:
+			var req message.ChannelRequest
+
+			if err := json.Unmarshal(env.Data, &req); err != nil {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed channel request")
+				continue
+			}
+
+			submit(cs.hub.metrics, "channelOps", cs.hub.channelOps, channelOp{client: client, requestID: env.RequestID, kind: env.Type, channel: req.Channel})
+		case message.TypeTyping:
+			var typing message.Typing
+
+			if err := json.Unmarshal(env.Data, &typing); err != nil {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed typing notification")
+				continue
+			}
+
+			typing.Username = client.Username
+			submit(cs.hub.metrics, "typing", cs.hub.typing, typing)
+		case message.TypeReceipt:
+			var receipt message.Receipt
+
+			if err := json.Unmarshal(env.Data, &receipt); err != nil || receipt.Status != message.ReceiptRead || receipt.MessageID == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed read receipt")
+				continue
+			}
+			receipt.Reader = client.Username
+			submit(cs.hub.metrics, "receipts", cs.hub.receipts, receipt)
+		case message.TypeMessageEdit:
+			var edit message.MessageEdit
+
+			if err := json.Unmarshal(env.Data, &edit); err != nil || edit.ID == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed message edit")
+				continue
+			}
+
+			if strings.TrimSpace(edit.Message) == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorEmptyMessage, "Message cannot be empty")
+				continue
+			}
+
+			if limit := cs.options.Load().MaxMessageLength; utf8.RuneCountInString(edit.Message) > limit {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorMessageTooLong,
+					fmt.Sprintf("Message cannot be longer than %d characters", limit))
+				continue
+			}
+
+			submit(cs.hub.metrics, "edits", cs.hub.edits, editOp{client: client, requestID: env.RequestID, kind: env.Type, id: edit.ID, text: edit.Message})
+		case message.TypeMessageDelete:
+			var del message.MessageDelete
+
+			if err := json.Unmarshal(env.Data, &del); err != nil || del.ID == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed message deletion")
+				continue
+			}
 
-		msg.Username = client.Username
-		cs.hub.broadcast <- msg
+			submit(cs.hub.metrics, "edits", cs.hub.edits, editOp{client: client, requestID: env.RequestID, kind: env.Type, id: del.ID})
+		case message.TypeReaction:
+			var reaction message.Reaction
+
+			if err := json.Unmarshal(env.Data, &reaction); err != nil || reaction.MessageID == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed reaction")
+				continue
+			}
+
+			if reaction.Emoji == "" || len(reaction.Emoji) > message.MaxEmojiLength || strings.ContainsAny(reaction.Emoji, " \t\r\n") {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Reactions must be a single emoji")
+				continue
+			}
+
+			submit(cs.hub.metrics, "reactions", cs.hub.reactions, reactionOp{client: client, requestID: env.RequestID, reaction: reaction})
+		case message.TypeThread:
+			var req message.ThreadRequest
+
+			if err := json.Unmarshal(env.Data, &req); err != nil || req.ParentID == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed thread request")
+				continue
+			}
+
+			submit(cs.hub.metrics, "threads", cs.hub.threads, threadRequest{client: client, requestID: env.RequestID, parentID: req.ParentID})
+		case message.TypeModeration:
+			var req message.Moderation
+
+			if err := json.Unmarshal(env.Data, &req); err != nil || req.Target == "" {
+				cs.writeError(ctx, client, env.RequestID, message.ErrorBadRequest, "Malformed moderation request")
+				continue
+			}
+
+			submit(cs.hub.metrics, "moderations", cs.hub.moderations, moderationOp{client: client, requestID: env.RequestID, req: req})
+		default:
+			cs.writeError(ctx, client, env.RequestID, message.ErrorUnknownType, fmt.Sprintf("Unknown message type %q", env.Type))
+		}
 	}
 
 	c.Close(websocket.StatusNormalClosure, "")
@@ -110,111 +421,484 @@ func (cs ChatServer) handleUsernameRegistration(ctx context.Context, client *Con
 
 		err := wsjson.Read(ctx, client.Conn, &envelope)
 		if err != nil {
-			cs.logf("error reading envelope: %v", err)
+			client.log.Debug("closed before logging in", "err", err)
 			return false
 		}
 
-		if envelope.Type != message.TypeLoginRequest {
-			resp := message.MakeEnvelope(message.TypeLoginResponse, message.LoginResponse{
-				Success: false,
-				Message: "Expected login request",
-			})
-			wsjson.Write(ctx, client.Conn, resp)
+		// Everything sent before logging in counts against the login limit,
+		// so a connection cannot keep the server busy without trying one.
+		loginReq := message.LoginRequest{}
+		if envelope.Type == message.TypeLoginRequest {
+			json.Unmarshal(envelope.Data, &loginReq)
+		}
+
+		if client.certName != "" {
+			loginReq.Username = client.certName
+		}
+
+		ok, closed := cs.checkRate(ctx, client, rateLogins, loginReq.Username, envelope.RequestID)
+		if closed {
+			return false
+		}
+		if !ok {
 			continue
 		}
 
-		loginReq := message.LoginRequest{}
+		if envelope.Type == message.TypeHello {
+			if !cs.handleHello(ctx, client, envelope) {
+				return false
+			}
+			continue
+		}
 
-		json.Unmarshal(envelope.Data, &loginReq)
+		if envelope.Type != message.TypeLoginRequest {
+			cs.writeLoginFailure(ctx, client, loginBadRequest, "Expected login request")
+			continue
+		}
 
 		if loginReq.Username == "" {
-			resp := message.MakeEnvelope(message.TypeLoginResponse, message.LoginResponse{
-				Success: false,
-				Message: "Username cannot be empty",
-			})
-			wsjson.Write(ctx, client.Conn, resp)
+			cs.writeLoginFailure(ctx, client, loginInvalidUsername, "Username cannot be empty")
+			continue
+		}
+
+		if message.IsChannel(loginReq.Username) {
+			cs.writeLoginFailure(ctx, client, loginInvalidUsername, "Username cannot be a channel name")
 			continue
 		}
 
-		if len(loginReq.Username) > 32 {
-			resp := message.MakeEnvelope(message.TypeLoginResponse, message.LoginResponse{
-				Success: false,
-				Message: "Username cannot be longer than 32 characters",
-			})
-			wsjson.Write(ctx, client.Conn, resp)
+		if limit := cs.options.Load().MaxUsernameLength; len(loginReq.Username) > limit {
+			cs.writeLoginFailure(ctx, client, loginInvalidUsername, fmt.Sprintf("Username cannot be longer than %d characters", limit))
 			continue
 		}
 
-		if cs.hub.isUsernameTaken(loginReq.Username) {
-			resp := message.MakeEnvelope(message.TypeLoginResponse, message.LoginResponse{
-				Success: false,
-				Message: "Username is already taken",
-			})
-			wsjson.Write(ctx, client.Conn, resp)
+		if cs.hub.isBot(loginReq.Username) || cs.isAPIUser(loginReq.Username) {
+			cs.writeLoginFailure(ctx, client, loginReserved, "Username is reserved")
+			continue
+		}
 
+		if ban, ok := cs.hub.moderation.Banned(loginReq.Username, client.addr); ok {
+			client.log.Info("refused login of banned user", "login_as", loginReq.Username)
+			cs.writeLoginFailure(ctx, client, loginBanned, ban.describe())
 			continue
 		}
 
+		// A verified client certificate already proves who this is.
+		if client.certName == "" {
+			if cause, reason := cs.authenticate(loginReq); cause != "" {
+				client.log.Info("login failed", "login_as", loginReq.Username, "reason", cause)
+				cs.writeLoginFailure(ctx, client, cause, reason)
+				continue
+			}
+		}
+
+		token, err := cs.users.IssueToken(loginReq.Username)
+		if err != nil {
+			client.log.Error("failed to issue session token", "login_as", loginReq.Username, "err", err)
+		}
+
 		client.Username = loginReq.Username
+		client.Role = cs.hub.moderation.Role(client.Username)
+		client.resumeFrom = loginReq.LastSeq
 		resp := message.MakeEnvelope(message.TypeLoginResponse, message.LoginResponse{
-			Success: true,
-			Message: "Login successful",
+			Success:  true,
+			Message:  "Login successful",
+			Username: client.Username,
+			Token:    token,
 		})
-		wsjson.Write(ctx, client.Conn, resp)
+		cs.write(ctx, client, resp)
+		return true
+	}
+}
+
+// handleHello negotiates the protocol version and capabilities with the
+// client. It reports false if the client's version is too old to talk to.
+func (cs ChatServer) handleHello(ctx context.Context, client *ConnectedClient, envelope message.Envelope) bool {
+	var hello message.Hello
+	if err := json.Unmarshal(envelope.Data, &hello); err != nil {
+		cs.writeLoginFailure(ctx, client, loginBadRequest, "Malformed hello")
 		return true
 	}
+
+	if hello.Version < message.MinProtocolVersion {
+		// Anything that sends a hello understands error envelopes.
+		resp := message.MakeReply(envelope.RequestID, message.TypeError, message.Error{
+			Code:    message.ErrorUnsupportedVersion,
+			Message: fmt.Sprintf("Protocol version %d is no longer supported, please upgrade", hello.Version),
+		})
+		cs.write(ctx, client, resp)
+		client.Conn.Close(websocket.StatusPolicyViolation, "unsupported protocol version")
+		return false
+	}
+
+	client.capabilities = message.Negotiate(message.Capabilities, hello.Capabilities)
+	resp := message.MakeReply(envelope.RequestID, message.TypeHello, message.Hello{
+		Version:      min(hello.Version, message.ProtocolVersion),
+		Capabilities: client.capabilities,
+		Commands:     cs.hub.BotCommands(),
+
+		MaxMessageLength: cs.options.Load().MaxMessageLength,
+	})
+	cs.write(ctx, client, resp)
+	return true
+}
+
+// authenticate checks the credentials in req, registering a new account if
+// asked to. When they are rejected, it returns why, along with the reason
+// shown to the user.
+func (cs ChatServer) authenticate(req message.LoginRequest) (loginCause, string) {
+	if req.Token != "" {
+		if !cs.users.ValidateToken(req.Username, req.Token) {
+			return loginSessionExpired, "Session expired, please log in with your password"
+		}
+		return "", ""
+	}
+
+	if req.Register {
+		err := cs.users.Register(req.Username, req.Password)
+		if errors.Is(err, ErrUserExists) {
+			return loginUserExists, capitalize(err.Error())
+		}
+		if errors.Is(err, ErrWeakPassword) {
+			return loginWeakPassword, capitalize(err.Error())
+		}
+		if err != nil {
+			cs.log.Error("failed to register account", "username", req.Username, "err", err)
+			return loginInternal, "Could not create account"
+		}
+		return "", ""
+	}
+
+	if err := cs.users.Authenticate(req.Username, req.Password); err != nil {
+		return loginInvalidCredentials, "Invalid username or password"
+	}
+	return "", ""
+}
+
+// rejection asks the hub to queue an error for client.
+type rejection struct {
+	client    *ConnectedClient
+	requestID string
+	code      message.ErrorCode
+	reason    string
+}
+
+// writeError tells the client that the envelope it tagged with requestID was
+// rejected. Once the client has a send queue the error goes through the hub,
+// so that it is written by the client's writer like everything else.
+func (cs ChatServer) writeError(ctx context.Context, client *ConnectedClient, requestID string, code message.ErrorCode, reason string) {
+	if !client.supports(message.TypeError) {
+		return
+	}
+	if client.send != nil {
+		submit(cs.hub.metrics, "rejections", cs.hub.rejections, rejection{client: client, requestID: requestID, code: code, reason: reason})
+		return
+	}
+	cs.write(ctx, client, message.MakeReply(requestID, message.TypeError, message.Error{
+		Code:    code,
+		Message: reason,
+	}))
+}
+
+// write sends envelope to a client that is not logged in yet, and so has no
+// send queue, giving up after the queue's write timeout.
+func (cs ChatServer) write(ctx context.Context, client *ConnectedClient, envelope message.Envelope) {
+	ctx, cancel := context.WithTimeout(ctx, cs.hub.queue.WriteTimeout)
+	defer cancel()
+	wsjson.Write(ctx, client.Conn, envelope)
+}
+
+// loginCause classifies failed logins for the metrics.
+type loginCause string
+
+const (
+	loginBadRequest         loginCause = "bad_request"
+	loginInvalidUsername    loginCause = "invalid_username"
+	loginReserved           loginCause = "reserved"
+	loginBanned             loginCause = "banned"
+	loginRateLimited        loginCause = "rate_limited"
+	loginSessionExpired     loginCause = "session_expired"
+	loginUserExists         loginCause = "user_exists"
+	loginWeakPassword       loginCause = "weak_password"
+	loginInvalidCredentials loginCause = "invalid_credentials"
+	loginInternal           loginCause = "internal_error"
+)
+
+func (cs ChatServer) writeLoginFailure(ctx context.Context, client *ConnectedClient, cause loginCause, reason string) {
+	cs.hub.metrics.loginFailed(cause)
+	resp := message.MakeEnvelope(message.TypeLoginResponse, message.LoginResponse{
+		Success: false,
+		Message: reason,
+	})
+	cs.write(ctx, client, resp)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
 }
 
-func (hub Hub) Run() {
+func (hub *Hub) Run() {
 	for {
 		select {
 		case client := <-hub.register:
+			hub.replaceSessions(client.Username)
 			hub.clients[client] = true
+			hub.seenUsers[client.Username] = true
+			hub.metrics.clientConnected(client)
+			hub.replayHistory(client)
+			hub.deliverOffline(client)
+			if client.motd != "" && client.resumeFrom == 0 && client.supports(message.TypeNotice) {
+				hub.send(client, message.MakeEnvelope(message.TypeNotice, message.Notice{Message: client.motd}))
+			}
 			hub.broadcastUserList()
+			hub.broadcastChannelList()
 		case client := <-hub.unregister:
 			if _, ok := hub.clients[client]; ok {
 				delete(hub.clients, client)
-				client.Conn.Close(websocket.StatusNormalClosure, "")
+				close(client.send)
+				hub.metrics.clientDisconnected(client, !hub.isOnline(client.Username))
 				hub.broadcastUserList()
+				hub.broadcastChannelList()
+			}
+		case op := <-hub.channelOps:
+			hub.handleChannelOp(op)
+		case op := <-hub.edits:
+			hub.handleEditOp(op)
+		case op := <-hub.reactions:
+			hub.handleReaction(op)
+		case req := <-hub.threads:
+			hub.handleThreadRequest(req)
+		case r := <-hub.rejections:
+			hub.sendError(r.client, r.requestID, r.code, r.reason)
+		case op := <-hub.moderations:
+			hub.handleModeration(op)
+		case reply := <-hub.pings:
+			reply <- struct{}{}
+		case typing := <-hub.typing:
+			if message.IsChannel(typing.Destination) && !hub.isMember(typing.Destination, typing.Username) {
+				continue
+			}
+
+			envelope := message.MakeEnvelope(message.TypeTyping, typing)
+			for _, client := range hub.audience(typing.Username, typing.Destination) {
+				if client.Username != typing.Username {
+					hub.send(client, envelope)
+				}
+			}
+		case req := <-hub.broadcast:
+			msg := req.msg
+
+			if reason, muted := hub.mutedReason(msg.Username); muted && req.client != nil {
+				req.reject(hub, message.ErrorMuted, reason)
+				continue
+			}
+			if code, reason := hub.checkDestination(req); code != "" {
+				req.reject(hub, code, reason)
+				continue
+			}
+			if msg.ParentID != "" {
+				if code, reason := hub.checkParent(&msg); code != "" {
+					req.reject(hub, code, reason)
+					continue
+				}
 			}
-		case msg := <-hub.broadcast:
+
+			hub.seq++
+			msg.Seq = hub.seq
+			msg.ConversationSeq = hub.nextConversationSeq(msg)
+
 			envelope := message.MakeEnvelope(message.TypeChatMessage, msg)
 
-			fmt.Println("Broadcasting message to", msg.Destination)
+			hub.log.Debug("delivering message", "id", msg.ID, "from", msg.Username, "destination", msg.Destination)
 
-			if msg.Destination == "ALL" {
-				for client := range hub.clients {
-					wsjson.Write(context.Background(), client.Conn, envelope)
+			if err := hub.history.Append(msg); err != nil {
+				hub.log.Error("failed to record message in history", "id", msg.ID, "err", err)
+			}
+			if msg.ParentID != "" {
+				hub.recordReply(msg)
+			}
+
+			for _, client := range hub.audience(msg.Username, msg.Destination) {
+				if client == req.client {
+					hub.send(client, message.MakeReply(req.requestID, message.TypeChatMessage, msg))
+					continue
 				}
-			} else {
-				for client := range hub.clients {
-					if client.Username == msg.Destination || client.Username == msg.Username {
-						wsjson.Write(context.Background(), client.Conn, envelope)
-					}
+				if message.IsChannel(msg.Destination) || client.Username == msg.Username {
+					hub.send(client, envelope)
+					continue
 				}
+				hub.sendWithReceipt(client, envelope, message.Receipt{
+					MessageID: msg.ID,
+					Sender:    msg.Username,
+					Reader:    client.Username,
+					Status:    message.ReceiptDelivered,
+				})
+			}
+
+			if !message.IsChannel(msg.Destination) {
+				hub.queueOffline(msg)
+			}
+			if req.result != nil {
+				req.result <- chatResult{msg: msg}
 			}
-		case check := <-hub.checkUsername:
-			taken := false
+			hub.metrics.messageDelivered(message.IsChannel(msg.Destination))
+			hub.notifyBots(msg)
+			hub.notifyWebhooks(msg)
+		case receipt := <-hub.receipts:
+			if !hub.isReceiptFor(receipt) {
+				hub.log.Debug("dropping receipt for another message", "reader", receipt.Reader, "id", receipt.MessageID)
+				continue
+			}
+			envelope := message.MakeEnvelope(message.TypeReceipt, receipt)
 			for client := range hub.clients {
-				if client.Username == check.username {
-					taken = true
+				if client.Username == receipt.Sender {
+					hub.send(client, envelope)
 				}
 			}
-			check.response <- taken
 		}
 	}
 }
 
-func (hub Hub) isUsernameTaken(username string) bool {
-	responseChan := make(chan bool)
-	hub.checkUsername <- usernameCheck{
-		username: username,
-		response: responseChan,
+// checkDestination returns why the message of req cannot be delivered, or an
+// empty code if it can.
+func (hub *Hub) checkDestination(req chatRequest) (message.ErrorCode, string) {
+	msg := req.msg
+	if message.IsChannel(msg.Destination) {
+		if _, ok := hub.channels[msg.Destination]; !ok && msg.Destination != message.LobbyChannel {
+			return message.ErrorUnknownDestination, "Channel " + msg.Destination + " does not exist"
+		}
+		// Messages that did not come from a connection, posted by bots or
+		// through the HTTP API, may go to any channel.
+		if req.client != nil && !hub.isMember(msg.Destination, msg.Username) {
+			return message.ErrorNotMember, "Not a member of " + msg.Destination
+		}
+		return "", ""
+	}
+
+	if msg.Destination == msg.Username || hub.isOnline(msg.Destination) || hub.isKnownUser(msg.Destination) || hub.isBot(msg.Destination) {
+		return "", ""
+	}
+	return message.ErrorUnknownDestination, "Unknown user " + msg.Destination
+}
+
+// isReceiptFor reports whether receipt is about a direct message its Sender
+// sent to its Reader, so users cannot make up receipts for messages they were
+// never sent.
+func (hub *Hub) isReceiptFor(receipt message.Receipt) bool {
+	msg, ok := hub.history.Get(receipt.MessageID)
+	return ok && !message.IsChannel(msg.Destination) && msg.Username == receipt.Sender && msg.Destination == receipt.Reader
+}
+
+// sendError tells client that the envelope it tagged with requestID was
+// rejected. client may be nil for messages that did not come from a
+// connection.
+func (hub *Hub) sendError(client *ConnectedClient, requestID string, code message.ErrorCode, reason string) {
+	if client == nil {
+		return
+	}
+	hub.send(client, message.MakeReply(requestID, message.TypeError, message.Error{
+		Code:    code,
+		Message: reason,
+	}))
+}
+
+func (hub *Hub) nextConversationSeq(msg message.ChatMessage) uint64 {
+	key := conversationKey(msg)
+
+	last, ok := hub.conversationSeqs[key]
+	if !ok {
+		previous, err := hub.history.Recent(1, func(m message.ChatMessage) bool {
+			return conversationKey(m) == key
+		})
+		if err == nil && len(previous) > 0 {
+			last = previous[0].ConversationSeq
+		}
 	}
-	return <-responseChan
+
+	hub.conversationSeqs[key] = last + 1
+	return last + 1
 }
 
-func (hub Hub) broadcastUserList() {
+func newMessageID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// replaceSessions disconnects every client already logged in as username, so
+// that a new login, such as a client resuming after a dropped connection the
+// server has not noticed yet, takes over the account.
+func (hub *Hub) replaceSessions(username string) {
+	for client := range hub.clients {
+		if client.Username != username {
+			continue
+		}
+		delete(hub.clients, client)
+		close(client.send)
+		// The new session is registered right after, so the user's write
+		// latencies are kept.
+		hub.metrics.clientDisconnected(client, false)
+		go client.Conn.Close(message.CloseSessionReplaced, "logged in from another session")
+	}
+}
+
+// audience returns the connected clients that should receive something sent
+// by sender to destination: every member of a channel, or both ends of a
+// direct message.
+func (hub *Hub) audience(sender string, destination string) []*ConnectedClient {
+	var clients []*ConnectedClient
+	for client := range hub.clients {
+		if message.IsChannel(destination) {
+			if hub.isMember(destination, client.Username) {
+				clients = append(clients, client)
+			}
+		} else if client.Username == destination || client.Username == sender {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// replayHistory sends a newly registered client the recent messages of its
+// conversations or, when it is resuming a session, the ones it missed.
+func (hub *Hub) replayHistory(client *ConnectedClient) {
+	// Messages queued while the user was offline are delivered separately.
+	queued := make(map[string]bool)
+	for _, msg := range hub.pending[client.Username] {
+		queued[msg.ID] = true
+	}
+
+	visible := func(msg message.ChatMessage) bool {
+		return !queued[msg.ID] && hub.canSee(client.Username, msg)
+	}
+
+	var (
+		msgs []message.ChatMessage
+		err  error
+	)
+	if client.resumeFrom > 0 {
+		msgs, err = hub.history.Since(client.resumeFrom, visible)
+		if len(msgs) > historyResumeLimit {
+			msgs = msgs[len(msgs)-historyResumeLimit:]
+		}
+	} else {
+		msgs, err = hub.history.Recent(historyReplayLimit, visible)
+	}
+	if err != nil {
+		client.log.Error("failed to load history", "err", err)
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+
+	envelope := message.MakeEnvelope(message.TypeHistory, message.History{Messages: msgs})
+	hub.send(client, envelope)
+}
+
+func (hub *Hub) broadcastUserList() {
 	userList := message.UserListUpdate{
 		Users: make([]string, 0, len(hub.clients)),
 	}
@@ -222,9 +906,12 @@ func (hub Hub) broadcastUserList() {
 	for client := range hub.clients {
 		userList.Users = append(userList.Users, client.Username)
 	}
+	for name := range hub.bots {
+		userList.Users = append(userList.Users, name)
+	}
 
 	envelope := message.MakeEnvelope(message.TypeUserListUpdate, userList)
 	for client := range hub.clients {
-		wsjson.Write(context.Background(), client.Conn, envelope)
+		hub.send(client, envelope)
 	}
 }
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// startServer returns a server with a running hub and accounts for alice
+// and bob, both with the password "correct horse".
+func startServer(t *testing.T) (*Hub, *ChatServer) {
+	t.Helper()
+	users, err := OpenUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := users.Register(name, "correct horse"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hub := startHub(t)
+	return hub, CreateChatServer(discard, hub, users)
+}
+
+// login connects to cs as username, announcing caps in the hello.
+func login(t *testing.T, cs *ChatServer, username string, caps ...message.Capability) *websocket.Conn {
+	t.Helper()
+	c := dialServer(t, cs)
+	send(t, c, message.MakeEnvelope(message.TypeHello, message.Hello{Version: message.ProtocolVersion, Capabilities: caps}))
+	read[message.Hello](t, c, message.TypeHello)
+
+	send(t, c, message.MakeEnvelope(message.TypeLoginRequest, message.LoginRequest{Username: username, Password: "correct horse"}))
+	if resp := read[message.LoginResponse](t, c, message.TypeLoginResponse); !resp.Success {
+		t.Fatalf("login as %s failed: %s", username, resp.Message)
+	}
+	return c
+}
+
+func send(t *testing.T, c *websocket.Conn, envelope message.Envelope) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := wsjson.Write(ctx, c, envelope); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// read returns the data of the next envelope of type typ read from c,
+// skipping the others.
+func read[T any](t *testing.T, c *websocket.Conn, typ message.MessageType) T {
+	t.Helper()
+	// Hashing passwords takes a while, more so with -race.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		var env message.Envelope
+		if err := wsjson.Read(ctx, c, &env); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if env.Type != typ {
+			continue
+		}
+		var data T
+		if err := json.Unmarshal(env.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+}
+
+func TestErrorsAreQueued(t *testing.T) {
+	hub, cs := startServer(t)
+	c := login(t, cs, "alice", message.CapErrors)
+	settle(t, hub)
+
+	envelope := message.MakeEnvelope(message.TypeChatMessage, message.ChatMessage{Destination: message.LobbyChannel, Message: " "})
+	envelope.RequestID = "42"
+	send(t, c, envelope)
+
+	if err := read[message.Error](t, c, message.TypeError); err.Code != message.ErrorEmptyMessage {
+		t.Errorf("got %+v, want %s", err, message.ErrorEmptyMessage)
+	}
+	if !strings.Contains(metricsText(hub), `chatui_hub_backlog{channel="rejections"} 0`) {
+		t.Error("the error was not handed to the hub")
+	}
+}
+
+func TestMOTDWithoutModeration(t *testing.T) {
+	_, cs := startServer(t)
+	opts := DefaultServerOptions
+	opts.MOTD = "Welcome!"
+	cs.SetOptions(opts)
+
+	c := login(t, cs, "alice", message.CapHistory, message.CapNotices)
+	if notice := read[message.Notice](t, c, message.TypeNotice); notice.Message != "Welcome!" {
+		t.Errorf("got notice %q, want the message of the day", notice.Message)
+	}
+}
+
+func TestHelloAnnouncesMessageLength(t *testing.T) {
+	_, cs := startServer(t)
+	opts := DefaultServerOptions
+	opts.MaxMessageLength = 500
+	cs.SetOptions(opts)
+
+	c := dialServer(t, cs)
+	send(t, c, message.MakeEnvelope(message.TypeHello, message.Hello{Version: message.ProtocolVersion}))
+	if hello := read[message.Hello](t, c, message.TypeHello); hello.MaxMessageLength != 500 {
+		t.Errorf("hello announces %d characters, want 500", hello.MaxMessageLength)
+	}
+}
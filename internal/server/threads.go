@@ -0,0 +1,72 @@
+package server
+
+import (
+	"slices"
+
+	message "chatui/internal/protocol"
+)
+
+// threadRequest asks the hub for a thread on behalf of client.
+type threadRequest struct {
+	client    *ConnectedClient
+	requestID string
+	parentID  string
+}
+
+// checkParent points msg.ParentID at the message that started the thread
+// msg replies to. It returns why msg cannot be posted there, or an empty
+// code if it can.
+func (hub *Hub) checkParent(msg *message.ChatMessage) (message.ErrorCode, string) {
+	parent, ok := hub.history.Get(msg.ParentID)
+	if ok && parent.ParentID != "" {
+		parent, ok = hub.history.Get(parent.ParentID)
+	}
+	if !ok || parent.Deleted || conversationKey(parent) != conversationKey(*msg) {
+		return message.ErrorUnknownMessage, "Cannot reply to a message that is not in this conversation"
+	}
+
+	msg.ParentID = parent.ID
+	return "", ""
+}
+
+// recordReply counts reply on the message that started its thread and adds
+// its author to the thread members.
+func (hub *Hub) recordReply(reply message.ChatMessage) {
+	parent, ok := hub.history.Get(reply.ParentID)
+	if !ok {
+		return
+	}
+
+	parent.Replies++
+	members := parent.ThreadMembers
+	if len(members) == 0 {
+		members = []string{parent.Username}
+	}
+	if !slices.Contains(members, reply.Username) {
+		members = append(slices.Clone(members), reply.Username)
+	}
+	parent.ThreadMembers = members
+
+	if err := hub.history.Update(parent); err != nil {
+		hub.log.Error("failed to record reply in history", "id", parent.ID, "err", err)
+	}
+	hub.updateOffline(parent)
+}
+
+func (hub *Hub) handleThreadRequest(req threadRequest) {
+	parent, ok := hub.history.Get(req.parentID)
+	if !ok || !hub.canSee(req.client.Username, parent) {
+		hub.sendError(req.client, req.requestID, message.ErrorUnknownMessage, "Message not found")
+		return
+	}
+
+	replies, err := hub.history.Replies(parent.ID)
+	if err != nil {
+		hub.log.Error("failed to load thread", "id", parent.ID, "err", err)
+	}
+
+	hub.send(req.client, message.MakeReply(req.requestID, message.TypeThread, message.Thread{
+		Parent:  parent,
+		Replies: replies,
+	}))
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	passwordIterations = 600_000
+	passwordKeyLength  = 32
+	minPasswordLength  = 8
+	sessionTTL         = time.Hour * 24 * 30
+)
+
+var (
+	ErrUserExists         = errors.New("username is already registered")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrWeakPassword       = errors.New("password must be at least 8 characters")
+)
+
+type account struct {
+	Salt       string `json:"salt"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+}
+
+type session struct {
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+type userStoreData struct {
+	Users map[string]account `json:"users"`
+	// Sessions is keyed by the SHA-256 of the token, so a leaked file
+	// cannot be used to log in.
+	Sessions map[string]session `json:"sessions"`
+}
+
+// UserStore keeps registered accounts, with PBKDF2 hashed passwords, and
+// the session tokens handed out on login. Everything is written to a JSON
+// file after each change. An empty path keeps the store in memory only.
+type UserStore struct {
+	mu   sync.Mutex
+	path string
+	data userStoreData
+}
+
+// OpenUserStore loads the accounts stored at path, creating the store if the
+// file does not exist yet.
+func OpenUserStore(path string) (*UserStore, error) {
+	us := &UserStore{
+		path: path,
+		data: userStoreData{
+			Users:    make(map[string]account),
+			Sessions: make(map[string]session),
+		},
+	}
+	if path == "" {
+		return us, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return us, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &us.data); err != nil {
+		return nil, err
+	}
+	if us.data.Users == nil {
+		us.data.Users = make(map[string]account)
+	}
+	if us.data.Sessions == nil {
+		us.data.Sessions = make(map[string]session)
+	}
+
+	return us, nil
+}
+
+// Register creates an account for username.
+func (us *UserStore) Register(username string, password string) error {
+	if len(password) < minPasswordLength {
+		return ErrWeakPassword
+	}
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyLength)
+	if err != nil {
+		return err
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if _, ok := us.data.Users[username]; ok {
+		return ErrUserExists
+	}
+	us.data.Users[username] = account{
+		Salt:       hex.EncodeToString(salt),
+		Hash:       hex.EncodeToString(hash),
+		Iterations: passwordIterations,
+	}
+	return us.save()
+}
+
+// Authenticate checks password against the one username registered with.
+func (us *UserStore) Authenticate(username string, password string) error {
+	us.mu.Lock()
+	acc, ok := us.data.Users[username]
+	us.mu.Unlock()
+
+	if !ok {
+		// Hash anyway so unknown usernames take as long as wrong passwords.
+		pbkdf2.Key(sha256.New, password, make([]byte, 16), passwordIterations, passwordKeyLength)
+		return ErrInvalidCredentials
+	}
+
+	salt, err := hex.DecodeString(acc.Salt)
+	if err != nil {
+		return err
+	}
+	want, err := hex.DecodeString(acc.Hash)
+	if err != nil {
+		return err
+	}
+
+	got, err := pbkdf2.Key(sha256.New, password, salt, acc.Iterations, len(want))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// Exists reports whether username has registered an account.
+func (us *UserStore) Exists(username string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	_, ok := us.data.Users[username]
+	return ok
+}
+
+// IssueToken creates a session token that can be used instead of the
+// password until it expires.
+func (us *UserStore) IssueToken(username string) (string, error) {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	now := time.Now()
+	for key, s := range us.data.Sessions {
+		if now.After(s.Expires) {
+			delete(us.data.Sessions, key)
+		}
+	}
+	us.data.Sessions[hashToken(token)] = session{
+		Username: username,
+		Expires:  now.Add(sessionTTL),
+	}
+
+	return token, us.save()
+}
+
+// ValidateToken reports whether token is an unexpired session of username.
+func (us *UserStore) ValidateToken(username string, token string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	s, ok := us.data.Sessions[hashToken(token)]
+	if !ok || time.Now().After(s.Expires) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(s.Username), []byte(username)) == 1
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// save writes the store to disk. The caller must hold us.mu.
+func (us *UserStore) save() error {
+	if us.path == "" {
+		return nil
+	}
+	return writeJSONFile(us.path, us.data)
+}
+
+// writeJSONFile replaces the file at path with v, encoded as JSON, without
+// ever leaving a partially written file behind.
+func writeJSONFile(path string, v any) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+// Webhook posts the channel messages it matches, as JSON, to an outside
+// service. Private messages are never sent to webhooks.
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret signs every request: the X-Chatui-Signature header holds
+	// "sha256=" followed by the hex encoded HMAC-SHA256 of the body.
+	Secret string `json:"secret,omitempty"`
+	// Channels limits the webhook to these channels; it gets all of them if
+	// empty.
+	Channels []string `json:"channels,omitempty"`
+	// Match is a regular expression the text of a message must match, such
+	// as "^!deploy ". Every message matches if it is empty.
+	Match string `json:"match,omitempty"`
+}
+
+// WebhookPayload is the body of a webhook request.
+type WebhookPayload struct {
+	Event   string              `json:"event"`
+	Message message.ChatMessage `json:"message"`
+}
+
+// LoadWebhooks reads a JSON array of webhooks from path.
+func LoadWebhooks(path string) ([]Webhook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []Webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("reading webhooks from %s: %w", path, err)
+	}
+	for _, hook := range hooks {
+		if _, err := hook.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return hooks, nil
+}
+
+func (hook Webhook) compile() (*regexp.Regexp, error) {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q", hook.URL)
+	}
+	for _, channel := range hook.Channels {
+		if !message.IsChannel(channel) {
+			return nil, fmt.Errorf("webhook %s: invalid channel %q", hook.URL, channel)
+		}
+	}
+	if hook.Match == "" {
+		return nil, nil
+	}
+	match, err := regexp.Compile(hook.Match)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s: %w", hook.URL, err)
+	}
+	return match, nil
+}
+
+const (
+	// webhookInboxSize is how many messages may wait for a webhook before
+	// new ones are dropped.
+	webhookInboxSize = 256
+	// webhookAttempts is how many times a delivery is tried, waiting twice
+	// as long as before, starting at webhookBackoff, between attempts.
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+	webhookTimeout  = 10 * time.Second
+)
+
+// webhookSender delivers the messages of one webhook, in order, on a
+// goroutine of its own so a slow receiver never holds up the hub.
+type webhookSender struct {
+	log    *slog.Logger
+	hook   Webhook
+	match  *regexp.Regexp
+	inbox  chan message.ChatMessage
+	client *http.Client
+	// backoff is the wait before the first retry.
+	backoff time.Duration
+}
+
+// AddWebhook starts posting the messages matching hook. It must be called
+// before Run.
+func (hub *Hub) AddWebhook(hook Webhook) error {
+	match, err := hook.compile()
+	if err != nil {
+		return err
+	}
+
+	sender := &webhookSender{
+		log:    hub.log.With("webhook", hook.URL),
+		hook:   hook,
+		match:  match,
+		inbox:  make(chan message.ChatMessage, webhookInboxSize),
+		client: &http.Client{Timeout: webhookTimeout},
+
+		backoff: webhookBackoff,
+	}
+	hub.webhooks = append(hub.webhooks, sender)
+	go sender.run()
+	return nil
+}
+
+func (s *webhookSender) matches(msg message.ChatMessage) bool {
+	if !message.IsChannel(msg.Destination) {
+		return false
+	}
+	if len(s.hook.Channels) > 0 && !slices.Contains(s.hook.Channels, msg.Destination) {
+		return false
+	}
+	return s.match == nil || s.match.MatchString(msg.Message)
+}
+
+func (s *webhookSender) run() {
+	for msg := range s.inbox {
+		body, err := json.Marshal(WebhookPayload{Event: "message", Message: msg})
+		if err != nil {
+			s.log.Error("failed to encode webhook payload", "id", msg.ID, "err", err)
+			continue
+		}
+
+		backoff := s.backoff
+		for attempt := 1; ; attempt++ {
+			retry, err := s.post(msg.ID, body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt == webhookAttempts {
+				s.log.Error("giving up on webhook delivery", "id", msg.ID, "attempts", attempt, "err", err)
+				break
+			}
+			s.log.Warn("webhook delivery failed, retrying", "id", msg.ID, "attempt", attempt, "backoff", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post makes one delivery attempt. It reports whether a failure is worth
+// retrying: network errors, rate limiting and server errors are, other
+// responses are not.
+func (s *webhookSender) post(id string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chatui-webhook")
+	req.Header.Set("X-Chatui-Event", "message")
+	req.Header.Set("X-Chatui-Delivery", id)
+	if s.hook.Secret != "" {
+		req.Header.Set("X-Chatui-Signature", SignWebhook(s.hook.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+}
+
+// SignWebhook returns the X-Chatui-Signature header of a webhook request
+// with the given body. Receivers compute it with their copy of the secret and
+// compare it to the header with hmac.Equal.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks hands msg to the webhooks it matches, without ever blocking
+// the hub.
+func (hub *Hub) notifyWebhooks(msg message.ChatMessage) {
+	for _, sender := range hub.webhooks {
+		if !sender.matches(msg) {
+			continue
+		}
+		select {
+		case sender.inbox <- msg:
+		default:
+			sender.log.Warn("webhook is falling behind, dropping message", "id", msg.ID)
+		}
+	}
+}
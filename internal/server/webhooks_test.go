@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	message "chatui/internal/protocol"
+)
+
+// delivery is a request received by a webhook receiver.
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver is an httptest server standing in for the service behind a
+// webhook. It answers with the statuses given, then 204.
+func receiver(t *testing.T, statuses ...int) (*httptest.Server, chan delivery) {
+	t.Helper()
+	deliveries := make(chan delivery, 16)
+	attempt := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{header: r.Header, body: body}
+
+		status := http.StatusNoContent
+		if attempt < len(statuses) {
+			status = statuses[attempt]
+		}
+		attempt++
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, deliveries
+}
+
+// startWebhookHub runs a hub posting to hook, retrying after a millisecond.
+func startWebhookHub(t *testing.T, hook Webhook) *Hub {
+	t.Helper()
+	hub := newHub()
+	if err := hub.AddWebhook(hook); err != nil {
+		t.Fatal(err)
+	}
+	hub.webhooks[0].backoff = time.Millisecond
+	go hub.Run()
+	return hub
+}
+
+func next(t *testing.T, deliveries chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("the webhook was not called")
+		return delivery{}
+	}
+}
+
+func nothing(t *testing.T, deliveries chan delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected webhook call with %s", d.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	srv, deliveries := receiver(t)
+	hub := startWebhookHub(t, Webhook{URL: srv.URL, Secret: "s3cret", Match: "^!deploy "})
+	alice := connect(t, hub, "alice")
+	connect(t, hub, "bob")
+
+	say(hub, alice, message.LobbyChannel, "not for the webhook")
+	say(hub, alice, "bob", "!deploy private")
+	say(hub, alice, message.LobbyChannel, "!deploy web")
+
+	d := next(t, deliveries)
+	want := SignWebhook("s3cret", d.body)
+	if got := d.header.Get("X-Chatui-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("signature %q does not match the body, want %q", got, want)
+	}
+	if d.header.Get("Content-Type") != "application/json" || d.header.Get("X-Chatui-Event") != "message" {
+		t.Errorf("unexpected headers %v", d.header)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(d.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "message" || payload.Message.Username != "alice" || payload.Message.Message != "!deploy web" {
+		t.Errorf("payload is %+v", payload)
+	}
+	if d.header.Get("X-Chatui-Delivery") != payload.Message.ID {
+		t.Errorf("delivery ID %q is not the message ID %q", d.header.Get("X-Chatui-Delivery"), payload.Message.ID)
+	}
+	nothing(t, deliveries)
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '{"event":"message"}' | openssl dgst -sha256 -hmac key
+	const want = "sha256=4718254b5e5d6d6d2472e9241c945a8252d492dfcb74285f321938c84206c3f6"
+	if got := SignWebhook("key", []byte(`{"event":"message"}`)); got != want {
+		t.Errorf("SignWebhook() = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	srv, deliveries := receiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusInternalServerError)
+	hub := startWebhookHub(t, Webhook{URL: srv.URL})
+	alice := connect(t, hub, "alice")
+
+	say(hub, alice, message.LobbyChannel, "hello")
+
+	first := next(t, deliveries)
+	for range 3 {
+		if d := next(t, deliveries); string(d.body) != string(first.body) {
+			t.Errorf("retried with %s, want %s", d.body, first.body)
+		}
+	}
+	nothing(t, deliveries)
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	statuses := make([]int, 10)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	srv, deliveries := receiver(t, statuses...)
+	hub := startWebhookHub(t, Webhook{URL: srv.URL})
+	alice := connect(t, hub, "alice")
+
+	say(hub, alice, message.LobbyChannel, "hello")
+	for range webhookAttempts {
+		next(t, deliveries)
+	}
+	nothing(t, deliveries)
+}
+
+func TestWebhookNoRetryOnClientError(t *testing.T) {
+	srv, deliveries := receiver(t, http.StatusBadRequest)
+	hub := startWebhookHub(t, Webhook{URL: srv.URL, Channels: []string{"ALL"}})
+	alice := connect(t, hub, "alice")
+
+	say(hub, alice, message.LobbyChannel, "hello")
+	next(t, deliveries)
+	nothing(t, deliveries)
+}